@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newAWSSession returns the session and config AWS streams create their
+// clients with. An STS role is used when set, then static keys, and the
+// IAM role of the instance otherwise. endpoint overrides the service
+// endpoint, e.g. to point at a local emulator.
+func newAWSSession(accessKey, secretAccessKey, awsRegion, awsSTSRole, endpoint string) (*session.Session, *aws.Config) {
+
+	sess := &session.Session{}
+	awsConfig := &aws.Config{Region: aws.String(awsRegion)}
+
+	if awsSTSRole != "" {
+		sess = session.Must(session.NewSession())
+		creds := stscreds.NewCredentials(sess, awsSTSRole)
+		awsConfig.Credentials = creds
+	} else if accessKey == "" || secretAccessKey == "" {
+		// try IAM
+		sess = session.New(nil)
+	} else {
+		creds := credentials.NewStaticCredentials(accessKey, secretAccessKey, "")
+		config := &aws.Config{
+			Region:      aws.String(awsRegion),
+			Credentials: creds,
+		}
+		sess = session.New(config)
+	}
+
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+
+	return sess, awsConfig
+}
@@ -155,7 +155,25 @@ func start(configPath string) {
 	allFiles := []Logfile{}
 	for _, logfile := range config.Logfiles {
 
-		if logfile.Directory != "" {
+		if logfile.Input == "journald" {
+
+			if savedState, ok := lastState[journalStateKey(logfile)]; ok {
+				logfile.Cursor = savedState.Cursor
+			}
+			wg.Add(1)
+			go func(logfile Logfile) {
+				defer wg.Done()
+				MonitorJournal(ctx, logfile)
+			}(logfile)
+		} else if logfile.Listen != "" {
+
+			// syslog messages instead of a file, nothing to checkpoint
+			wg.Add(1)
+			go func(logfile Logfile) {
+				defer wg.Done()
+				MonitorSyslog(ctx, logfile)
+			}(logfile)
+		} else if logfile.Directory != "" {
 
 			// since we will have a monitor, just send the strings to the monitor
 			wildcard := logfile.Directory
@@ -180,7 +198,7 @@ func start(configPath string) {
 			wg.Add(1)
 			go func(logfile Logfile) {
 				defer wg.Done()
-				MonitorDir(ctx, logfile, files)
+				MonitorDir(ctx, logfile, files, lastState)
 			}(logfile)
 		} else {
 			allFiles = append(allFiles, logfile)
@@ -192,6 +210,7 @@ func start(configPath string) {
 
 		if savedState, ok := lastState[logfile.Filename]; ok {
 			logfile.LastTimestamp = savedState.LastTimestamp
+			logfile.Checkpoint = savedState.Checkpoint
 		}
 
 		wg.Add(1)
@@ -202,7 +221,15 @@ func start(configPath string) {
 
 	}
 
-	go updateStateFileInterval(ctx)
+	// the state file is written until the streams are closed so the
+	// records they flush on shutdown still advance the checkpoints
+	stateCtx, stateCancel := context.WithCancel(context.Background())
+	stateDone := make(chan bool)
+	go func() {
+		updateStateFileInterval(stateCtx)
+		close(stateDone)
+	}()
+
 	wg.Wait()
 	cancel()
 
@@ -210,4 +237,7 @@ func start(configPath string) {
 		log.WithField("stream", streamName).Infof("closing stream")
 		stream.Close()
 	}
+
+	stateCancel()
+	<-stateDone
 }
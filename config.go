@@ -12,6 +12,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"pushr/tail"
 	"regexp"
 	"strings"
 	"time"
@@ -50,20 +51,41 @@ type Logfile struct {
 	LineRegex          string            `yaml:"line_regex" ini:"line_regex"  json:"line_regex"`
 	FrontSplitRegexStr string            `yaml:"front_split_regex" ini:"front_split_regex"  json:"front_split_regex,omitempty"` // option used to split at the begining of the line instead
 	ParseMode          string            `yaml:"parse_mode" ini:"parse_mode" json:"parse_mode"`
+	Preset             string            `yaml:"preset" ini:"preset" json:"preset,omitempty"` // built-in parser for a common format, e.g. nginx_combined
+	Parsers            []ParserConfig    `yaml:"-" ini:"-" json:"parsers,omitempty"`          // parser chain, from a list in parse_mode
 	ParserOptions      []string          `yaml:"parser_options"`
 	RetryFileOpen      bool              `yaml:"retry_file_open" ini:"retry_file_open" json:"retry_file_open,omitempty"`
 	FieldMappings      map[string]string `yaml:"field_mappings" json:"field_mappings,omitempty"`
+	Transforms         []TransformConfig `yaml:"transforms" ini:"-" json:"transforms,omitempty"` // steps applied to the attributes of every parsed line
+	Redact             *RedactConfig     `yaml:"redact" ini:"-" json:"redact,omitempty"`         // pii to mask, hash or truncate before streaming
+	Filter             *FilterConfig     `yaml:"filter" ini:"-" json:"filter,omitempty"`         // lines to drop or sample before streaming
 	BufferMultiLines   bool              `yaml:"buffer_multi_lines" ini:"buffer_multi_lines" json:"buffer_multi_lines,omitempty"`
+	MultilinePattern   string            `yaml:"multiline_pattern" ini:"multiline_pattern" json:"multiline_pattern,omitempty"`       // continuation lines of a message, e.g. '^\s' for stack traces
+	MultilineNegate    bool              `yaml:"multiline_negate" ini:"multiline_negate" json:"multiline_negate,omitempty"`          // the lines that don't match multiline_pattern are the continuation lines
+	MultilineMatch     string            `yaml:"multiline_match" ini:"multiline_match" json:"multiline_match,omitempty"`             // after or before, the line continuation lines go with
+	MultilineMaxLines  int               `yaml:"multiline_max_lines" ini:"multiline_max_lines" json:"multiline_max_lines,omitempty"` // the rest of a longer message is dropped, 500 by default
+	MultilineTimeout   string            `yaml:"multiline_timeout" ini:"multiline_timeout" json:"multiline_timeout,omitempty"`       // how long to wait for more lines, 5s by default
+	MultilineRegex     *regexp.Regexp    `yaml:"-" ini:"-" json:"-"`
 	FieldsOrder        []string          `yaml:"fields_order" json:"fields_order,omitempty"`
 	FieldsOrderStr     string            `ini:"fields_order" json:"-"`
 	ParserPluginPath   string            `yaml:"parser_plugin_path"`
 	LastTimestamp      time.Time         `json:"-"`
+	Checkpoint         *tail.Checkpoint  `yaml:"-" ini:"-" json:"-"`
 	Regex              *regexp.Regexp    `json:"-"`
 	FrontSplitRegex    *regexp.Regexp    `json:"-"`
 	SkipHeaderLine     bool              `yaml:"skip_header_line"`
 	SkipToEnd          bool              `yaml:"skip_to_end"`
+	RotatedPattern     string            `yaml:"rotated_pattern" ini:"rotated_pattern" json:"rotated_pattern,omitempty"`    // glob of rotated copies to catch up on at startup
+	Listen             string            `yaml:"listen" ini:"listen" json:"listen,omitempty"`                               // syslog listener instead of a file, e.g. udp://0.0.0.0:514
+	Input              string            `yaml:"input" ini:"input" json:"input,omitempty"`                                  // journald to read the systemd journal instead of a file
+	JournalUnits       string            `yaml:"journal_units" ini:"journal_units" json:"journal_units,omitempty"`          // comma separated units to read, all when empty
+	JournalPriority    string            `yaml:"journal_priority" ini:"journal_priority" json:"journal_priority,omitempty"` // lowest priority to read, e.g. warning
+	Cursor             string            `yaml:"-" ini:"-" json:"-"`
+	GrokPatternFiles   []string          `yaml:"grok_pattern_files" ini:"grok_pattern_files" json:"grok_pattern_files,omitempty"` // pattern files for the grok parse_mode, comma separated in ini
 	KvRegexStr         string            `yaml:"kv_regex"`
 	KvRegex            *regexp.Regexp    `json:"-"`
+	redactor           *Redactor
+	filter             *LineFilter
 }
 
 type StreamConfig struct {
@@ -143,6 +165,29 @@ func parseConfig(configPath string) ConfigFile {
 		}
 	}
 
+	for i := range config.Logfiles {
+		if err := config.Logfiles[i].applyPreset(); err != nil {
+			log.Fatalf("Error loading preset. %v", err)
+		}
+		config.Logfiles[i].applyContainerDefaults()
+		if err := config.Logfiles[i].applyMultiline(); err != nil {
+			log.Fatalf("Error loading multiline settings. %v", err)
+		}
+		if err := config.Logfiles[i].applyTransforms(); err != nil {
+			log.Fatalf("Error loading transforms. %v", err)
+		}
+		if err := config.Logfiles[i].applyRedact(); err != nil {
+			log.Fatalf("Error loading redact settings. %v", err)
+		}
+		if err := config.Logfiles[i].applyFilter(); err != nil {
+			log.Fatalf("Error loading filter. %v", err)
+		}
+		if len(config.Logfiles[i].Parsers) > 0 && config.Logfiles[i].TimeFormat == "" {
+			// the chain converts the event_datetime of its parsers to it
+			config.Logfiles[i].TimeFormat = time.RFC3339Nano
+		}
+	}
+
 	if err := config.validate(); err != nil {
 		log.Fatalf("Error validating config. %v", err)
 	}
@@ -155,6 +200,14 @@ func parseConfig(configPath string) ConfigFile {
 
 func (config *ConfigFile) validate() error {
 
+	for _, logfile := range config.Logfiles {
+		switch logfile.Input {
+		case "", "file", "journald":
+		default:
+			return fmt.Errorf("logfile %s has unknown input %s", logfile.Name, logfile.Input)
+		}
+	}
+
 	for _, stream := range config.Streams {
 		for _, recordFormat := range stream.RecordFormat {
 			switch recordFormat.Type {
@@ -215,11 +268,30 @@ func configureStreams(ctx context.Context, config ConfigFile) map[string]Streame
 		case "firehose":
 			log.WithField("stream", streamName).Infof("streaming to firehose: %s", conf.Name)
 			stream = NewFirehoseStream(ctx, conf.RecordFormat, config.AwsAccessKey,
-				config.AwsSecretAccessKey, config.AwsRegion, config.AwsSTSRole, conf.Name)
+				config.AwsSecretAccessKey, config.AwsRegion, config.AwsSTSRole, conf.Name, conf.Options)
 		case "s3":
 			log.WithField("stream", streamName).Info("streaming to s3")
 			stream = NewS3Stream(ctx, conf.RecordFormat, config.AwsAccessKey,
 				config.AwsSecretAccessKey, config.AwsRegion, config.AwsSTSRole, conf.Name, conf.Options)
+		case "kinesis":
+			log.WithField("stream", streamName).Infof("streaming to kinesis: %s", conf.Name)
+			stream = NewKinesisStream(ctx, conf.RecordFormat, config.AwsAccessKey,
+				config.AwsSecretAccessKey, config.AwsRegion, config.AwsSTSRole, conf.Name, conf.Options)
+		case "elasticsearch", "opensearch":
+			log.WithField("stream", streamName).Infof("streaming to %s: %s", conf.Type, conf.Url)
+			stream = NewElasticsearchStream(ctx, conf.RecordFormat, conf.Url, conf.Name, conf.Options)
+		case "loki":
+			log.WithField("stream", streamName).Infof("streaming to loki: %s", conf.Url)
+			stream = NewLokiStream(ctx, conf.RecordFormat, conf.Url, conf.Name, conf.Options)
+		case "splunk_hec":
+			log.WithField("stream", streamName).Infof("streaming to splunk: %s", conf.Url)
+			stream = NewSplunkStream(ctx, conf.RecordFormat, conf.Url, conf.Name, conf.Options)
+		case "syslog":
+			log.WithField("stream", streamName).Infof("streaming to syslog: %s", conf.Url)
+			stream = NewSyslogStream(ctx, conf.RecordFormat, conf.Url, conf.Name, conf.Options)
+		case "kafka":
+			log.WithField("stream", streamName).Info("streaming to kafka")
+			stream = NewKafkaStream(ctx, conf.RecordFormat, conf.Name, conf.Options)
 		case "csv":
 			filename := conf.Name + ".csv"
 			log.WithField("stream", streamName).Infof("streaming to csv %s", filename)
@@ -227,12 +299,24 @@ func configureStreams(ctx context.Context, config ConfigFile) map[string]Streame
 			break
 		case "http":
 			log.WithField("stream", streamName).Info("streaming to http")
-			stream = NewDCHTTPStream(conf.RecordFormat, conf.Url, conf.StreamApiKey, 125000)
+			stream = NewHTTPStream(ctx, conf.RecordFormat, conf.Url, conf.StreamApiKey, conf.Name, conf.Options)
 			break
 		default:
 			log.Fatalf("stream type: %s not supported", conf.Type)
 		}
 
+		redactConfig, err := redactConfigFromOptions(ParseOptions(conf.Options))
+		if err != nil {
+			log.WithField("stream", streamName).Fatal(err.Error())
+		}
+		if redactConfig != nil {
+			redactor, err := NewRedactor(*redactConfig)
+			if err != nil {
+				log.WithField("stream", streamName).Fatal(err.Error())
+			}
+			stream = NewRedactStream(stream, redactor)
+		}
+
 		allStreams[streamName] = stream
 
 	}
@@ -98,20 +98,30 @@ func parseLogfileSection(cfg *ini.File, sectionName string) Logfile {
 		n.FrontSplitRegex = regexp.MustCompile(n.FrontSplitRegexStr)
 	}
 
-	if n.ParseMode == "regex" {
+	if strings.Contains(n.ParseMode, ",") {
+		// parser chain, the parsers share the settings of the section
+		for _, mode := range strings.Split(n.ParseMode, ",") {
+			n.Parsers = append(n.Parsers, ParserConfig{ParseMode: strings.TrimSpace(mode)})
+		}
+		n.ParseMode = ""
+		subsectionName := fmt.Sprintf("%s.field_mappings", sectionName)
+		if subsection, err := cfg.GetSection(subsectionName); err == nil {
+			n.FieldMappings = parseFieldMappings(subsection)
+		}
+	} else if n.ParseMode == "regex" {
 		n.Regex = regexp.MustCompile(n.LineRegex)
-	} else if n.ParseMode == "json" || n.ParseMode == "date_keyvalue" {
+	} else if n.ParseMode == "json" || n.ParseMode == "date_keyvalue" || n.ParseMode == "logfmt" {
 		subsectionName := fmt.Sprintf("%s.field_mappings", sectionName)
 		subsection, err := cfg.GetSection(subsectionName)
 		if err != nil {
 			log.Fatalf("json needs subsection with field_mappings")
 		}
-		keyNames := subsection.KeyStrings()
-		keyValues := subsection.Keys()
-		n.FieldMappings = make(map[string]string, len(keyNames))
-
-		for i := 0; i < len(keyNames); i++ {
-			n.FieldMappings[keyNames[i]] = keyValues[i].String()
+		n.FieldMappings = parseFieldMappings(subsection)
+	} else if n.ParseMode == "grok" || n.Preset != "" {
+		// optional, presets come with their own field_mappings
+		subsectionName := fmt.Sprintf("%s.field_mappings", sectionName)
+		if subsection, err := cfg.GetSection(subsectionName); err == nil {
+			n.FieldMappings = parseFieldMappings(subsection)
 		}
 	} else if n.ParseMode == "csv" {
 		n.FieldsOrder = parseFieldOrder(n.FieldsOrderStr)
@@ -124,6 +134,18 @@ func parseLogfileSection(cfg *ini.File, sectionName string) Logfile {
 
 }
 
+func parseFieldMappings(subsection *ini.Section) map[string]string {
+
+	keyNames := subsection.KeyStrings()
+	keyValues := subsection.Keys()
+	fieldMappings := make(map[string]string, len(keyNames))
+
+	for i := 0; i < len(keyNames); i++ {
+		fieldMappings[keyNames[i]] = keyValues[i].String()
+	}
+	return fieldMappings
+}
+
 func parseFieldOrder(fieldOrder string) []string {
 	return strings.Split(fieldOrder, ",")
 }
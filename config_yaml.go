@@ -58,6 +58,41 @@ func parseYamlConfig(src io.Reader) ConfigFile {
 	return config
 }
 
+// UnmarshalYAML reads a list in parse_mode as a parser chain.
+func (l *Logfile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	type plainLogfile Logfile
+
+	var chain struct {
+		ParseMode []ParserConfig `yaml:"parse_mode"`
+	}
+	if err := unmarshal(&chain); err != nil || len(chain.ParseMode) == 0 {
+		return unmarshal((*plainLogfile)(l))
+	}
+
+	// decode everything else without the list
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	rest := yaml.MapSlice{}
+	for _, item := range fields {
+		if key, ok := item.Key.(string); !ok || key != "parse_mode" {
+			rest = append(rest, item)
+		}
+	}
+	data, err := yaml.Marshal(rest)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, (*plainLogfile)(l)); err != nil {
+		return err
+	}
+
+	l.Parsers = chain.ParseMode
+	return nil
+}
+
 func setConfigLogfileRegex(config ConfigFile, regex *regexp.Regexp, line []byte) {
 	matches := regex.FindSubmatch(line)
 	if len(matches) == 3 {
@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// lines dropped by the filters, by logfile name and reason. the files
+	// of a directory share their counters.
+	gFilterDrops      = make(map[string]map[string]*uint64)
+	gFilterDropsMutex = new(sync.Mutex)
+)
+
+// FilterConfig decides which lines of a logfile are streamed. A line has
+// to match one of the include rules when there are any and none of the
+// exclude rules, then it's sampled.
+type FilterConfig struct {
+	Include    []FilterRule       `yaml:"include" json:"include,omitempty"`
+	Exclude    []FilterRule       `yaml:"exclude" json:"exclude,omitempty"`
+	LevelRates map[string]float64 `yaml:"level_rates" json:"level_rates,omitempty"` // share of the lines of a log_level to keep
+	SampleBy   string             `yaml:"sample_by" json:"sample_by,omitempty"`     // attribute to sample on, the same values are always kept
+	SampleRate float64            `yaml:"sample_rate" json:"sample_rate,omitempty"` // share of the sample_by values to keep
+}
+
+// FilterRule matches the raw line with a regex or an attribute with a
+// condition. Values are compared case insensitive.
+type FilterRule struct {
+	Line    string   `yaml:"line" json:"line,omitempty"`
+	Field   string   `yaml:"field" json:"field,omitempty"`
+	Equals  string   `yaml:"equals" json:"equals,omitempty"`
+	In      []string `yaml:"in" json:"in,omitempty"`
+	Matches string   `yaml:"matches" json:"matches,omitempty"`
+	lineRe  *regexp.Regexp
+	fieldRe *regexp.Regexp
+}
+
+func (r *FilterRule) compile() error {
+
+	var err error
+	if r.Line != "" {
+		if r.lineRe, err = regexp.Compile(r.Line); err != nil {
+			return err
+		}
+	}
+
+	if r.Field == "" {
+		if r.Line == "" {
+			return fmt.Errorf("a rule needs a line regex or a field")
+		}
+		return nil
+	}
+	if r.Equals == "" && len(r.In) == 0 && r.Matches == "" {
+		return fmt.Errorf("rule on %s needs equals, in or matches", r.Field)
+	}
+	if r.Matches != "" {
+		if r.fieldRe, err = regexp.Compile(r.Matches); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match is true when every condition of the rule holds.
+func (r *FilterRule) match(line string, attributes map[string]string) bool {
+
+	if r.lineRe != nil && !r.lineRe.MatchString(line) {
+		return false
+	}
+	if r.Field == "" {
+		return true
+	}
+
+	val, _ := filterAttribute(attributes, r.Field)
+	if r.Equals != "" && !strings.EqualFold(val, r.Equals) {
+		return false
+	}
+	if len(r.In) > 0 {
+		found := false
+		for _, v := range r.In {
+			if strings.EqualFold(val, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.fieldRe != nil && !r.fieldRe.MatchString(val) {
+		return false
+	}
+	return true
+}
+
+// filterAttribute returns the value of an attribute for the filter. browser
+// and os are worked out from user_agent when the record format of the
+// stream doesn't have them.
+func filterAttribute(attributes map[string]string, key string) (string, bool) {
+
+	if val, ok := attributes[key]; ok {
+		return val, true
+	}
+
+	userAgent, ok := attributes["user_agent"]
+	if !ok {
+		return "", false
+	}
+	switch key {
+	case "browser", "browser_ver":
+		browser, browserVer := parseBrowser(userAgent)
+		if key == "browser" {
+			return browser, true
+		}
+		return browserVer, true
+	case "os", "os_ver":
+		os, osVer := parseOS(userAgent)
+		if key == "os" {
+			return os, true
+		}
+		return osVer, true
+	}
+	return "", false
+}
+
+// LineFilter applies a FilterConfig and counts what it drops.
+type LineFilter struct {
+	config FilterConfig
+	drops  map[string]*uint64
+
+	mu      sync.Mutex
+	credits map[string]float64 // level rate sampling, a line is kept for every whole credit
+}
+
+func NewLineFilter(name string, config FilterConfig) (*LineFilter, error) {
+
+	for _, rules := range [][]FilterRule{config.Include, config.Exclude} {
+		for i := range rules {
+			if err := rules[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	levelRates := make(map[string]float64)
+	for level, rate := range config.LevelRates {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("level rate of %s must be between 0 and 1", level)
+		}
+		levelRates[strings.ToLower(level)] = rate
+	}
+	config.LevelRates = levelRates
+
+	if config.SampleBy != "" && (config.SampleRate < 0 || config.SampleRate > 1) {
+		return nil, fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+
+	return &LineFilter{
+		config:  config,
+		drops:   filterDropCounters(name),
+		credits: make(map[string]float64),
+	}, nil
+}
+
+// filterDropCounters returns the counters of a logfile.
+func filterDropCounters(logfileName string) map[string]*uint64 {
+
+	gFilterDropsMutex.Lock()
+	defer gFilterDropsMutex.Unlock()
+
+	counters, ok := gFilterDrops[logfileName]
+	if !ok {
+		counters = make(map[string]*uint64)
+		for _, reason := range []string{"include", "exclude", "level_rate", "sample"} {
+			counters[reason] = new(uint64)
+		}
+		gFilterDrops[logfileName] = counters
+	}
+	return counters
+}
+
+// FilterDrops returns how many lines the filters dropped, by logfile name
+// and reason.
+func FilterDrops() map[string]map[string]uint64 {
+
+	gFilterDropsMutex.Lock()
+	defer gFilterDropsMutex.Unlock()
+
+	drops := make(map[string]map[string]uint64)
+	for logfileName, counters := range gFilterDrops {
+		drops[logfileName] = make(map[string]uint64)
+		for reason, counter := range counters {
+			drops[logfileName][reason] = atomic.LoadUint64(counter)
+		}
+	}
+	return drops
+}
+
+// Keep is false for lines that are filtered out.
+func (f *LineFilter) Keep(line string, attributes map[string]string) bool {
+
+	reason := f.dropReason(line, attributes)
+	if reason == "" {
+		return true
+	}
+	atomic.AddUint64(f.drops[reason], 1)
+	return false
+}
+
+func (f *LineFilter) dropReason(line string, attributes map[string]string) string {
+
+	if len(f.config.Include) > 0 {
+		included := false
+		for i := range f.config.Include {
+			if f.config.Include[i].match(line, attributes) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "include"
+		}
+	}
+
+	for i := range f.config.Exclude {
+		if f.config.Exclude[i].match(line, attributes) {
+			return "exclude"
+		}
+	}
+
+	level := strings.ToLower(attributes["log_level"])
+	if rate, ok := f.config.LevelRates[level]; ok {
+		f.mu.Lock()
+		credit := f.credits[level] + rate
+		keep := credit >= 1
+		if keep {
+			credit -= 1
+		}
+		f.credits[level] = credit
+		f.mu.Unlock()
+		if !keep {
+			return "level_rate"
+		}
+	}
+
+	if f.config.SampleBy != "" {
+		val, ok := filterAttribute(attributes, f.config.SampleBy)
+		if ok && !isUnset(val) {
+			h := fnv.New32a()
+			h.Write([]byte(val))
+			if float64(h.Sum32())/float64(math.MaxUint32+1) >= f.config.SampleRate {
+				return "sample"
+			}
+		}
+	}
+
+	return ""
+}
+
+// applyFilter builds the filter of a logfile.
+func (l *Logfile) applyFilter() error {
+
+	if l.Filter == nil {
+		return nil
+	}
+
+	filter, err := NewLineFilter(l.Name, *l.Filter)
+	if err != nil {
+		return fmt.Errorf("logfile %s filter: %s", l.Name, err.Error())
+	}
+	l.filter = filter
+	return nil
+}
+
+// keepLine is false when the filter of the logfile drops the line.
+func keepLine(logfile Logfile, line string, record *Record) bool {
+	if logfile.filter == nil || record == nil {
+		return true
+	}
+	return logfile.filter.Keep(line, record.EventAttributes)
+}
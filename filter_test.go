@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var filterTestConfig = `
+files:
+  - name: filtered
+    file: /var/log/app.log
+    parse_mode: regex
+    line_regex: '^(?P<log_level>\w+) (?P<http_path>\S+) "(?P<user_agent>[^"]*)"'
+    filter:
+      include:
+        - {field: log_level, in: [info, debug, error]}
+      exclude:
+        - {field: browser, equals: aws-elb}
+        - {line: 'password='}
+      level_rates:
+        DEBUG: 0.5
+`
+
+func TestMonitorFileFilter(t *testing.T) {
+
+	data := `info /v1/users "Mozilla/5.0 (X11; Linux x86_64) Firefox/50.0"` + "\n" +
+		`info /health "ELB-HealthChecker/2.0"` + "\n" +
+		`warn /v1/users "curl/7.50"` + "\n" +
+		`info /login?password=hunter2 "curl/7.50"` + "\n" +
+		`debug /v1/a "curl/7.50"` + "\n" +
+		`debug /v1/b "curl/7.50"` + "\n" +
+		`debug /v1/c "curl/7.50"` + "\n" +
+		`debug /v1/d "curl/7.50"` + "\n" +
+		`error /v1/users "curl/7.50"` + "\n"
+
+	config := parseYamlConfig(strings.NewReader(filterTestConfig))
+	logfile := config.Logfiles[0]
+	logfile.StreamName = "filtered"
+
+	// the drops of earlier runs of the test would add up
+	gFilterDropsMutex.Lock()
+	delete(gFilterDrops, "filtered")
+	gFilterDropsMutex.Unlock()
+
+	if err := logfile.applyFilter(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, logfile, stream, data, false)
+
+	paths := []string{}
+	for _, record := range stream.records {
+		paths = append(paths, record.EventAttributes["http_path"])
+	}
+	if strings.Join(paths, " ") != "/v1/users /v1/b /v1/d /v1/users" {
+		t.Fatalf("unexpected records %v", paths)
+	}
+
+	expected := map[string]uint64{"include": 1, "exclude": 2, "level_rate": 2, "sample": 0}
+	if drops := FilterDrops()["filtered"]; fmt.Sprint(drops) != fmt.Sprint(expected) {
+		t.Errorf("expected drops %v, got %v", expected, drops)
+	}
+
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("expected the checkpoint at the end of the file, got %+v", last.Checkpoint)
+	}
+
+	rw := httptest.NewRecorder()
+	filterStats(rw, httptest.NewRequest("GET", "/1/filter_stats", nil))
+	var resp struct {
+		Dropped map[string]map[string]uint64 `json:"dropped"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.Dropped["filtered"]["exclude"] != 2 {
+		t.Errorf("unexpected filter_stats response %v %v", resp, err)
+	}
+}
+
+func TestMonitorFileFilteredContainerParts(t *testing.T) {
+
+	data := "2016-10-06T00:17:09.669794202Z stdout P GET \n" +
+		"2016-10-06T00:17:09.669794203Z stdout F /health\n"
+
+	logfile := Logfile{
+		Name:       "containers",
+		StreamName: "containers",
+		ParseMode:  "cri",
+		TimeFormat: time.RFC3339Nano,
+		Filter:     &FilterConfig{Exclude: []FilterRule{{Field: "log_line", Equals: "GET /health"}}},
+	}
+	if err := logfile.applyFilter(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the checkpoint has to move past the filtered message without
+	// waiting for another line
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, logfile, stream, data, true)
+
+	if len(stream.records) != 0 {
+		t.Fatalf("expected the message to be filtered, got %v", stream.records)
+	}
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("checkpoint held back by the filtered message, got %+v", last.Checkpoint)
+	}
+}
+
+func TestFilterAttribute(t *testing.T) {
+
+	// without browser and os in the record format, the filter works them
+	// out from user_agent
+	attributes := map[string]string{"user_agent": "ELB-HealthChecker/2.0"}
+	if browser, ok := filterAttribute(attributes, "browser"); !ok || browser != "aws-elb" {
+		t.Errorf("expected browser aws-elb, got %q", browser)
+	}
+	if _, ok := filterAttribute(map[string]string{}, "browser"); ok {
+		t.Errorf("expected no browser without user_agent")
+	}
+	if val, ok := filterAttribute(map[string]string{"browser": "\\N"}, "browser"); !ok || val != "\\N" {
+		t.Errorf("expected the browser of the record, got %q", val)
+	}
+}
+
+func TestLineFilterSample(t *testing.T) {
+
+	filter, err := NewLineFilter("sampled", FilterConfig{SampleBy: "user_tag", SampleRate: 0.25})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		attributes := map[string]string{"user_tag": fmt.Sprintf("user-%d", i)}
+		keep := filter.Keep("", attributes)
+		if filter.Keep("", attributes) != keep {
+			t.Fatalf("expected user-%d to be sampled the same way every time", i)
+		}
+		if keep {
+			kept += 1
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about a quarter of the users, kept %d", kept)
+	}
+
+	// lines without the attribute can't be sampled
+	if !filter.Keep("", map[string]string{"user_tag": "\\N"}) {
+		t.Errorf("expected a line without user_tag to be kept")
+	}
+
+	for _, config := range []FilterConfig{
+		{Include: []FilterRule{{}}},
+		{Exclude: []FilterRule{{Field: "log_level"}}},
+		{Exclude: []FilterRule{{Line: "("}}},
+		{LevelRates: map[string]float64{"debug": 2}},
+		{SampleBy: "user_tag", SampleRate: -1},
+	} {
+		if _, err := NewLineFilter("invalid", config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
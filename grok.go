@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	GROK_MAX_DEPTH = 32
+)
+
+// %{NAME}, %{NAME:field} or %{NAME:field:type}, the type is ignored since
+// the record format already says how to convert a field
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::\w+)?\}`)
+
+// what's left of references grokReference doesn't take, like
+// %{IP:[client][ip]}
+var grokLeftover = regexp.MustCompile(`%\{[^}]*\}?`)
+
+// Grok expands grok expressions into the named group regexes the regex
+// parser uses.
+type Grok struct {
+	patterns map[string]string
+}
+
+// NewGrok returns a Grok with the bundled pattern library loaded.
+func NewGrok() *Grok {
+	g := &Grok{patterns: make(map[string]string)}
+	if err := g.addPatterns(strings.NewReader(grokDefaultPatterns)); err != nil {
+		panic(err.Error())
+	}
+	return g
+}
+
+// AddPatternFile loads a pattern file, one NAME regex per line with #
+// comments, the same format logstash uses. Patterns override the bundled
+// ones with the same name.
+func (g *Grok) AddPatternFile(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := g.addPatterns(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (g *Grok) addPatterns(r io.Reader) error {
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return fmt.Errorf("invalid pattern on line %d: %s", lineNumber, line)
+		}
+		g.patterns[fields[0]] = nonCapturing(strings.TrimSpace(fields[1]))
+	}
+
+	return scanner.Err()
+}
+
+// Compile expands the pattern references of expr. Named references become
+// named groups, everything else is non-capturing so the regex parser only
+// sees the fields asked for.
+func (g *Grok) Compile(expr string) (*regexp.Regexp, error) {
+
+	expanded, err := g.expand(expr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ref := grokLeftover.FindString(expanded); ref != "" {
+		return nil, fmt.Errorf("invalid grok reference %s, field names can only have letters, digits and _", ref)
+	}
+	return regexp.Compile(expanded)
+}
+
+func (g *Grok) expand(expr string, depth int) (string, error) {
+
+	if depth > GROK_MAX_DEPTH {
+		return "", fmt.Errorf("grok patterns nested too deep, recursive pattern in %s", expr)
+	}
+
+	var err error
+	expanded := grokReference.ReplaceAllStringFunc(expr, func(ref string) string {
+		match := grokReference.FindStringSubmatch(ref)
+		pattern, ok := g.patterns[match[1]]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("grok pattern %s not found", match[1])
+			}
+			return ref
+		}
+
+		sub, subErr := g.expand(pattern, depth+1)
+		if subErr != nil && err == nil {
+			err = subErr
+		}
+
+		if match[2] != "" {
+			return "(?P<" + match[2] + ">" + sub + ")"
+		}
+		return "(?:" + sub + ")"
+	})
+
+	return expanded, err
+}
+
+// nonCapturing turns the capturing groups of a pattern definition into
+// non-capturing ones, the parser would otherwise get unnamed fields.
+func nonCapturing(pattern string) string {
+
+	out := bytes.Buffer{}
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			out.WriteByte(c)
+			i += 1
+			c = pattern[i]
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// a ] right after [ or [^ is part of the class
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				out.WriteByte(c)
+				i += 1
+				c = pattern[i]
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				out.WriteByte(c)
+				i += 1
+				c = pattern[i]
+			}
+		case c == '(' && (i+1 >= len(pattern) || pattern[i+1] != '?'):
+			out.WriteString("(?:")
+			continue
+		}
+		out.WriteByte(c)
+	}
+
+	return out.String()
+}
+
+// compileGrok builds the regex of a grok logfile from its line_regex and
+// pattern files.
+func compileGrok(logfile Logfile) (*regexp.Regexp, error) {
+
+	g := NewGrok()
+	for _, path := range logfile.GrokPatternFiles {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if err := g.AddPatternFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.Compile(logfile.LineRegex)
+}
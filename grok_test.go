@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGrokDefaultPatterns(t *testing.T) {
+
+	g := NewGrok()
+	for name := range g.patterns {
+		if _, err := g.Compile("%{" + name + "}"); err != nil {
+			t.Errorf("pattern %s doesn't compile: %s", name, err.Error())
+		}
+	}
+}
+
+func TestGrokCombinedApacheLog(t *testing.T) {
+
+	re, err := NewGrok().Compile(`^%{COMBINEDAPACHELOG}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	parser := NewRegexParser("", "", "access.log", "host", re, testFormat)
+	result, err := parser.Parse(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := map[string]string{
+		"clientip":  "127.0.0.1",
+		"auth":      "frank",
+		"timestamp": "10/Oct/2000:13:55:36 -0700",
+		"verb":      "GET",
+		"request":   "/apache_pb.gif",
+		"response":  "200",
+		"bytes":     "2326",
+		"referrer":  `"http://www.example.com/start.html"`,
+		"agent":     `"Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+	}
+	for k, v := range want {
+		if result[k] != v {
+			t.Errorf("expected %s to be %s, got %s", k, v, result[k])
+		}
+	}
+	if _, ok := result[""]; ok {
+		t.Errorf("pattern definitions must not add unnamed groups")
+	}
+}
+
+func TestGrokPatternFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pushr-grok")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "patterns")
+	ioutil.WriteFile(path, []byte("# request ids\nREQUESTID req-(\\d+)\n"), 0644)
+
+	re, err := compileGrok(Logfile{
+		LineRegex:        `%{TIMESTAMP_ISO8601:event_datetime} %{LOGLEVEL:log_level} %{REQUESTID:request_id}`,
+		GrokPatternFiles: []string{path},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	match := re.FindStringSubmatch("2017-01-02T03:04:05Z WARN req-42")
+	if len(match) != 4 || match[1] != "2017-01-02T03:04:05Z" || match[2] != "WARN" || match[3] != "req-42" {
+		t.Fatalf("unexpected match %q of %s", match, re.String())
+	}
+
+	if _, err := NewGrok().Compile("%{NOPE:x}"); err == nil {
+		t.Fatal("expected an error for an unknown pattern")
+	}
+
+	for _, expr := range []string{`%{IP:[client][ip]} x`, `%{IP:@ip}`, `%{IP`} {
+		if _, err := NewGrok().Compile(expr); err == nil {
+			t.Errorf("expected an error for the reference in %s", expr)
+		}
+	}
+}
+
+func TestNonCapturing(t *testing.T) {
+
+	for in, want := range map[string]string{
+		`(a|b)(?:c)`:  `(?:a|b)(?:c)`,
+		`[(]\(x\)`:    `[(]\(x\)`,
+		`[]()](y)`:    `[]()](?:y)`,
+		`[^]()]+(z)`:  `[^]()]+(?:z)`,
+		`(?P<n>(\d))`: `(?P<n>(?:\d))`,
+	} {
+		if got := nonCapturing(in); got != want {
+			t.Errorf("expected %s for %s, got %s", want, in, got)
+		}
+	}
+}
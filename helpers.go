@@ -13,8 +13,12 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -57,6 +61,47 @@ func ParseOptions(options []string) map[string]string {
 	return optionsProps
 }
 
+// parseTLSOptions builds the TLS config of a stream from its options. It
+// returns nil unless tls is enabled or a certificate is given.
+func parseTLSOptions(opts map[string]string) *tls.Config {
+
+	enabled, _ := strconv.ParseBool(opts["tls"])
+	if !enabled && opts["tls_ca_file"] == "" && opts["tls_cert_file"] == "" {
+		return nil
+	}
+
+	config := &tls.Config{}
+
+	if val, ok := opts["tls_skip_verify"]; ok {
+		skip, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		config.InsecureSkipVerify = skip
+	}
+
+	if caFile := opts["tls_ca_file"]; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile := opts["tls_cert_file"]; certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, opts["tls_key_file"])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config
+}
+
 func LogFuncs(logfile Logfile) (func(msg string, args ...interface{}),
 	func(msg string, args ...interface{}),
 	func(msg string, args ...interface{}),
@@ -191,6 +236,11 @@ func getFileSize(path string) (int64, error) {
 	return fi.Size(), nil
 }
 
+// isUnset is isNull for attribute values, where a missing value is \N.
+func isUnset(value string) bool {
+	return value == "\\N" || isNull(value)
+}
+
 func isNull(value string) (isnull bool) {
 	isnull = false
 	for _, n := range []string{" ", "null", "none", "-", "empty", ""} {
@@ -332,11 +382,20 @@ func interfaceToString(inf interface{}) (string, error) {
 	case bool:
 		return strconv.FormatBool(inf.(bool)), nil
 	case float32:
-		return strconv.FormatFloat(inf.(float64), 'f', -1, 32), nil
+		return strconv.FormatFloat(float64(inf.(float32)), 'f', -1, 32), nil
 	case float64:
 		return strconv.FormatFloat(inf.(float64), 'f', -1, 64), nil
 	case uint64:
 		return strconv.FormatUint(inf.(uint64), 10), nil
+	case json.Number:
+		return inf.(json.Number).String(), nil
+	case map[string]interface{}, []interface{}:
+		// nested objects and arrays stay json
+		data, err := json.Marshal(inf)
+		if err != nil {
+			return fmt.Sprintf("%v", t), err
+		}
+		return string(data), nil
 	case error:
 		return inf.(error).Error(), nil
 	default:
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFormat is the record format shared by the tests.
+var testFormat = []Attribute{
+	{"event_datetime", "timestamp", 0, "", ""},
+	{"app", "string", 16, "", ""},
+	{"hostname", "string", 64, "", ""},
+	{"log_level", "string", 16, "", ""},
+	{"path", "string", 0, "", ""},
+	{"parser", "string", 32, "", ""},
+	{"remote_address", "string", 64, "", ""},
+	{"remote_user", "string", 64, "", ""},
+	{"http_method", "string", 16, "", ""},
+	{"http_path", "string", 0, "", ""},
+	{"http_referer", "string", 0, "", ""},
+	{"user_agent", "string", 0, "", ""},
+	{"response_bytes", "integer", 0, "", ""},
+	{"response_ms", "double", 0, "", ""},
+	{"browser", "string", 32, "", ""},
+	{"os", "string", 16, "", ""},
+	{"user_tag", "string", 64, "", ""},
+	{"device_tag", "string", 64, "", ""},
+	{"country", "string", 64, "", ""},
+	{"pod_name", "string", 64, "", ""},
+	{"namespace", "string", 64, "", ""},
+	{"container_name", "string", 64, "", ""},
+	{"stream", "string", 8, "", ""},
+	{"log_line", "string", 0, "", ""},
+}
+
+// testStream keeps the records streamed to it and acks them right away.
+type testStream struct {
+	mu      sync.Mutex
+	records []*Record
+	format  []Attribute
+}
+
+func (s *testStream) Stream(r *Record) error {
+	s.mu.Lock()
+	s.records = append(s.records, r)
+	s.mu.Unlock()
+	r.Ack()
+	return nil
+}
+
+func (s *testStream) RecordFormat() []Attribute { return s.format }
+func (s *testStream) Close()                    {}
+
+// monitorTestFile writes data to a temporary file and runs MonitorFile on
+// it as logfile, streaming to stream. Without follow it reads the file
+// once, with it the file is monitored until the checkpoint gets to the end
+// of data or 3 seconds pass. It returns the last checkpoint update.
+func monitorTestFile(t *testing.T, logfile Logfile, stream Streamer, data string, follow bool) UpdateMessage {
+
+	dir, err := ioutil.TempDir("", "pushr-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	logfile.Filename = filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(logfile.Filename, []byte(data), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer func(streams map[string]Streamer, follow bool) {
+		gAllStreams, gFollow = streams, follow
+	}(gAllStreams, gFollow)
+	gAllStreams = map[string]Streamer{logfile.StreamName: stream}
+	gFollow = follow
+
+	for len(gUpdateCacheChan) > 0 {
+		<-gUpdateCacheChan
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		MonitorFile(ctx, logfile)
+		close(done)
+	}()
+
+	var last UpdateMessage
+	timeout := time.After(time.Second * 3)
+LOOP:
+	for {
+		select {
+		case last = <-gUpdateCacheChan:
+			if follow && last.Checkpoint != nil && last.Checkpoint.Offset == int64(len(data)) {
+				break LOOP
+			}
+		case <-done:
+			break LOOP
+		case <-timeout:
+			break LOOP
+		}
+	}
+
+	cancel()
+	<-done
+	for len(gUpdateCacheChan) > 0 {
+		last = <-gUpdateCacheChan
+	}
+	return last
+}
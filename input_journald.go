@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JOURNAL_MAX_FIELD = 64 << 20 // 64MB
+)
+
+// journalStateKey is the state file key of a journald logfile, the journal
+// has no filename so it's keyed by the logfile name.
+func journalStateKey(logfile Logfile) string {
+	return "journald:" + logfile.Name
+}
+
+// MonitorJournal streams the entries of the systemd journal read with
+// journalctl in export format. The cursor of the last acked entry is kept
+// in the state file and journalctl resumes right after it.
+func MonitorJournal(ctx context.Context, logfile Logfile) error {
+
+	logfile.Filename = journalStateKey(logfile)
+	infof, _, errorf, _ := LogFuncs(logfile)
+
+	stream, ok := logfileStream(logfile)
+	if !ok {
+		return fmt.Errorf("stream %s not found for journal %s", logfile.StreamName, logfile.Name)
+	}
+
+	parser := newParser(logfile, stream)
+
+	if logfile.Cursor != "" {
+		infof("resuming after cursor %s", logfile.Cursor)
+	}
+
+	cmd := exec.CommandContext(ctx, "journalctl", journalctlArgs(logfile, gFollow)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		errorf("unable to read journalctl output: %s", err.Error())
+		return err
+	}
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		errorf("unable to start journalctl: %s", err.Error())
+		return err
+	}
+
+	tracker := newCheckpointTracker(logfile.Filename)
+	var streamed_entries_ctr uint64 = 0
+
+	err = readJournalExport(bufio.NewReader(stdout), func(entry map[string]string) {
+		record, eventDatetime := journalRecord(logfile, parser, entry, stream.RecordFormat())
+		if !keepLine(logfile, entry["MESSAGE"], record) {
+			tracker.trackCursor(entry["__CURSOR"], eventDatetime, 0)
+			return
+		}
+		record.SetAck(tracker.trackCursor(entry["__CURSOR"], eventDatetime, 1))
+		if err := stream.Stream(record); err != nil {
+			errorf("error streaming:\n%s", err.Error())
+		}
+		streamed_entries_ctr += 1
+	})
+	if err != nil && err != io.EOF && ctx.Err() == nil {
+		errorf("error reading the journal: %s", err.Error())
+	}
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		errorf("journalctl exited: %s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	infof("monitoring stop. streamed %d journal entries", streamed_entries_ctr)
+	return nil
+}
+
+// journalctlArgs builds the journalctl command line for a logfile.
+func journalctlArgs(logfile Logfile, follow bool) []string {
+
+	args := []string{"--output=export"}
+
+	if follow {
+		args = append(args, "--follow")
+	}
+
+	if logfile.Cursor != "" {
+		args = append(args, "--after-cursor="+logfile.Cursor)
+	} else if logfile.SkipToEnd {
+		args = append(args, "--lines=0")
+	} else if follow {
+		// --follow only shows the last 10 entries otherwise
+		args = append(args, "--no-tail")
+	}
+
+	for _, unit := range strings.Split(logfile.JournalUnits, ",") {
+		if unit = strings.TrimSpace(unit); unit != "" {
+			args = append(args, "--unit="+unit)
+		}
+	}
+
+	if logfile.JournalPriority != "" {
+		args = append(args, "--priority="+logfile.JournalPriority)
+	}
+
+	return args
+}
+
+// journalRecord runs MESSAGE through the parser and adds the journal
+// fields to the attributes the parser didn't set.
+func journalRecord(logfile Logfile, parser Parser, entry map[string]string, recordFormat []Attribute) (*Record, *time.Time) {
+
+	message := entry["MESSAGE"]
+	record, eventDatetime := processLine(logfile, parser, message, recordFormat)
+	if record == nil {
+		// services don't all log in one format, ship what can't be parsed as is
+		record = rawRecord(logfile, parser, message, recordFormat)
+	}
+
+	attributes := record.EventAttributes
+
+	if eventDatetime == nil {
+		if usec, err := strconv.ParseInt(entry["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+			t := time.Unix(0, usec*int64(time.Microsecond)).UTC()
+			attributes["event_datetime"] = t.Format(ISO_8601)
+			eventDatetime = &t
+		}
+	}
+	if hostname := entry["_HOSTNAME"]; hostname != "" {
+		attributes["hostname"] = hostname
+	}
+	if priority, err := strconv.Atoi(entry["PRIORITY"]); err == nil && priority >= 0 && priority < len(syslogSeverityNames) {
+		setUnset(attributes, "log_level", syslogSeverityNames[priority])
+	}
+	setUnset(attributes, "priority", entry["PRIORITY"])
+	setUnset(attributes, "systemd_unit", entry["_SYSTEMD_UNIT"])
+	setUnset(attributes, "app", entry["SYSLOG_IDENTIFIER"])
+
+	return record, eventDatetime
+}
+
+// readJournalExport calls fn with the fields of every entry in the journal
+// export format. Fields are KEY=value lines, or for binary values the key
+// on its own line followed by a little endian uint64 length, the data and
+// a newline. Entries end with an empty line, an entry cut off by the end of
+// the input is dropped.
+func readJournalExport(r *bufio.Reader, fn func(map[string]string)) error {
+
+	entry := map[string]string{}
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		line = line[:len(line)-1]
+
+		if len(line) == 0 {
+			if len(entry) > 0 {
+				fn(entry)
+				entry = map[string]string{}
+			}
+			continue
+		}
+
+		if eq := bytes.IndexByte(line, '='); eq >= 0 {
+			entry[string(line[:eq])] = string(line[eq+1:])
+			continue
+		}
+
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size > JOURNAL_MAX_FIELD {
+			return fmt.Errorf("journal field %s too large: %d bytes", line, size)
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		entry[string(line)] = string(data[:size])
+	}
+}
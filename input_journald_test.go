@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// journalExportFixture is two entries as journalctl -o export writes them,
+// the second with a binary MESSAGE.
+func journalExportFixture() []byte {
+
+	buf := bytes.Buffer{}
+	buf.WriteString("__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8ee4bbd9e4e4b2af3c2b0cc;m=4d1cad;t=4c61bd5b5b6b0;x=fa2a7b3b0ed4e9e2\n" +
+		"__REALTIME_TIMESTAMP=1342540861416409\n" +
+		"_HOSTNAME=web-1\n" +
+		"PRIORITY=3\n" +
+		"_SYSTEMD_UNIT=nginx.service\n" +
+		"SYSLOG_IDENTIFIER=nginx\n" +
+		"MESSAGE=path=/login upstream timed out\n" +
+		"\n")
+
+	message := "path=/\nmulti line"
+	buf.WriteString("__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8\n" +
+		"__REALTIME_TIMESTAMP=1342540861421465\n" +
+		"PRIORITY=6\n" +
+		"MESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(message)))
+	buf.WriteString(message + "\n\n")
+
+	// cut off by journalctl exiting
+	buf.WriteString("__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece9\nMESS")
+
+	return buf.Bytes()
+}
+
+func TestReadJournalExport(t *testing.T) {
+
+	entries := []map[string]string{}
+	err := readJournalExport(bufio.NewReader(bytes.NewReader(journalExportFixture())), func(entry map[string]string) {
+		entries = append(entries, entry)
+	})
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 complete entries, got %d", len(entries))
+	}
+	if entries[0]["_SYSTEMD_UNIT"] != "nginx.service" || entries[0]["MESSAGE"] != "path=/login upstream timed out" {
+		t.Fatalf("unexpected first entry %v", entries[0])
+	}
+	if entries[1]["MESSAGE"] != "path=/\nmulti line" || entries[1]["__CURSOR"] != "s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8" {
+		t.Fatalf("unexpected binary entry %v", entries[1])
+	}
+}
+
+func TestJournalRecord(t *testing.T) {
+
+	logfile := Logfile{Name: "system", Filename: "journald:system"}
+	parser := NewRegexParser("", "", logfile.Filename, "pushr-host", regexp.MustCompile(`^path=(?P<path>\S+)`), testFormat)
+
+	var entry map[string]string
+	readJournalExport(bufio.NewReader(bytes.NewReader(journalExportFixture())), func(e map[string]string) {
+		if entry == nil {
+			entry = e
+		}
+	})
+
+	r, eventDatetime := journalRecord(logfile, parser, entry, testFormat)
+
+	attrs := r.EventAttributes
+	if attrs["path"] != "/login" || attrs["hostname"] != "web-1" || attrs["app"] != "nginx" || attrs["log_level"] != "err" ||
+		attrs["systemd_unit"] != "nginx.service" || attrs["event_datetime"] != "2012-07-17T16:01:01.416Z" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+	if eventDatetime == nil || eventDatetime.Format(ISO_8601) != "2012-07-17T16:01:01.416Z" {
+		t.Fatalf("expected the journal timestamp as event time, got %v", eventDatetime)
+	}
+}
+
+func TestJournalctlArgs(t *testing.T) {
+
+	logfile := Logfile{JournalUnits: "nginx.service, sshd.service", JournalPriority: "warning"}
+	want := []string{"--output=export", "--follow", "--no-tail", "--unit=nginx.service", "--unit=sshd.service", "--priority=warning"}
+	if args := journalctlArgs(logfile, true); !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected %q, got %q", want, args)
+	}
+
+	logfile.Cursor = "s=abc;i=1"
+	want = []string{"--output=export", "--follow", "--after-cursor=s=abc;i=1", "--unit=nginx.service", "--unit=sshd.service", "--priority=warning"}
+	if args := journalctlArgs(logfile, true); !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected %q, got %q", want, args)
+	}
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSLOG_MAX_MESSAGE = 1 << 20 // 1MB
+	RFC3164_TIMESTAMP  = "Jan _2 15:04:05"
+)
+
+var (
+	syslogSeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	ErrSyslogPriority = errors.New("syslog message without a valid priority")
+)
+
+// syslogMessage holds the header fields of an RFC 3164 or RFC 5424 message.
+type syslogMessage struct {
+	Facility       int
+	Severity       int
+	Timestamp      *time.Time
+	Hostname       string
+	AppName        string
+	ProcId         string
+	MsgId          string
+	StructuredData map[string]string // params of all elements, by param name
+	Message        string
+}
+
+// MonitorSyslog listens for syslog messages on logfile.Listen and streams
+// their content through the logfile's parser like lines of a file.
+func MonitorSyslog(ctx context.Context, logfile Logfile) error {
+
+	infof, _, errorf, fatalf := LogFuncs(logfile)
+
+	stream, ok := logfileStream(logfile)
+	if !ok {
+		return fmt.Errorf("stream %s not found for listener %s", logfile.StreamName, logfile.Listen)
+	}
+
+	u, err := url.Parse(logfile.Listen)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") {
+		fatalf("listen must be udp://host:port or tcp://host:port, got %s", logfile.Listen)
+	}
+
+	// the parser fills filename with where the messages came from
+	logfile.Filename = logfile.Listen
+	parser := newParser(logfile, stream)
+
+	messages := make(chan []byte, 1024)
+	var closer io.Closer
+	wg := sync.WaitGroup{}
+
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.ListenPacket("udp", u.Host)
+		if err != nil {
+			errorf("unable to listen: %s", err.Error())
+			return err
+		}
+		closer = conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				messages <- append([]byte{}, buf[:n]...)
+			}
+		}()
+	case "tcp":
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			errorf("unable to listen: %s", err.Error())
+			return err
+		}
+		closer = ln
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns := sync.WaitGroup{}
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					conns.Wait()
+					return
+				}
+				conns.Add(1)
+				go func(conn net.Conn) {
+					defer conns.Done()
+					defer conn.Close()
+					// unblock the reader on shutdown, and stop waiting
+					// once the client hangs up
+					done := make(chan struct{})
+					defer close(done)
+					go func() {
+						select {
+						case <-ctx.Done():
+							conn.Close()
+						case <-done:
+						}
+					}()
+					err := readSyslogFrames(bufio.NewReader(conn), func(msg []byte) {
+						messages <- msg
+					})
+					if err != nil && err != io.EOF {
+						errorf("error reading from %s: %s", conn.RemoteAddr(), err.Error())
+					}
+				}(conn)
+			}
+		}()
+	}
+
+	infof("listening for syslog messages on %s", logfile.Listen)
+
+	go func() {
+		<-ctx.Done()
+		closer.Close()
+		wg.Wait()
+		close(messages)
+	}()
+
+	for data := range messages {
+
+		msg, err := parseSyslogMessage(data, time.Now())
+		if err != nil {
+			errorf("%s: %q", err.Error(), truncateString(string(data), 256))
+			continue
+		}
+
+		record := syslogRecord(logfile, parser, msg, stream.RecordFormat())
+		if !keepLine(logfile, msg.Message, record) {
+			continue
+		}
+		if err := stream.Stream(record); err != nil {
+			errorf("error streaming:\n%s", err.Error())
+		}
+	}
+
+	infof("listener stopped")
+	return nil
+}
+
+// syslogRecord runs the message content through the parser and adds the
+// header fields to the attributes the parser didn't set.
+func syslogRecord(logfile Logfile, parser Parser, msg syslogMessage, recordFormat []Attribute) *Record {
+
+	record, eventDatetime := processLine(logfile, parser, msg.Message, recordFormat)
+	if record == nil {
+		// appliances don't all log in one format, ship what can't be parsed as is
+		record = rawRecord(logfile, parser, msg.Message, recordFormat)
+	}
+
+	attributes := record.EventAttributes
+
+	if eventDatetime == nil && msg.Timestamp != nil {
+		attributes["event_datetime"] = msg.Timestamp.UTC().Format(ISO_8601)
+	}
+	if msg.Hostname != "" {
+		attributes["hostname"] = msg.Hostname
+	}
+	if msg.AppName != "" {
+		attributes["app"] = msg.AppName
+	}
+	setUnset(attributes, "log_level", syslogSeverityNames[msg.Severity])
+	setUnset(attributes, "syslog_facility", strconv.Itoa(msg.Facility))
+	setUnset(attributes, "syslog_severity", strconv.Itoa(msg.Severity))
+	setUnset(attributes, "syslog_procid", msg.ProcId)
+	setUnset(attributes, "syslog_msgid", msg.MsgId)
+	for key, val := range msg.StructuredData {
+		setUnset(attributes, key, val)
+	}
+
+	return record
+}
+
+// readSyslogFrames splits a tcp stream into messages. Frames starting with
+// a digit are octet counted, anything else is newline delimited (RFC 6587).
+func readSyslogFrames(r *bufio.Reader, fn func([]byte)) error {
+
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		if first[0] >= '0' && first[0] <= '9' {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil || n > SYSLOG_MAX_MESSAGE {
+				return fmt.Errorf("invalid frame length %q", length)
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return err
+			}
+			fn(msg)
+			continue
+		}
+
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			fn(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseSyslogMessage parses an RFC 5424 message, or an RFC 3164 one when
+// there's no version after the priority. now fills in the year RFC 3164
+// timestamps don't have.
+func parseSyslogMessage(data []byte, now time.Time) (syslogMessage, error) {
+
+	msg := syslogMessage{}
+	s := strings.TrimRight(string(data), "\r\n\x00")
+
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return msg, ErrSyslogPriority
+	}
+	// Atoi takes a sign, PRI is digits only
+	digits := s[1:end]
+	if strings.TrimLeft(digits, "0123456789") != "" {
+		return msg, ErrSyslogPriority
+	}
+	pri, err := strconv.Atoi(digits)
+	if err != nil || pri < 0 || pri > 191 {
+		return msg, ErrSyslogPriority
+	}
+	msg.Facility, msg.Severity = pri/8, pri%8
+	s = s[end+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		return parseRFC5424(msg, s[2:])
+	}
+	return parseRFC3164(msg, s, now), nil
+}
+
+func parseRFC5424(msg syslogMessage, s string) (syslogMessage, error) {
+
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		return msg, fmt.Errorf("truncated RFC 5424 header")
+	}
+
+	nilOr := func(val string) string {
+		if val == SYSLOG_NILVALUE {
+			return ""
+		}
+		return val
+	}
+
+	if fields[0] != SYSLOG_NILVALUE {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return msg, fmt.Errorf("invalid RFC 5424 timestamp %s", fields[0])
+		}
+		msg.Timestamp = &t
+	}
+	msg.Hostname = nilOr(fields[1])
+	msg.AppName = nilOr(fields[2])
+	msg.ProcId = nilOr(fields[3])
+	msg.MsgId = nilOr(fields[4])
+
+	rest := fields[5]
+	if strings.HasPrefix(rest, SYSLOG_NILVALUE) {
+		rest = rest[1:]
+	} else {
+		sd, n, err := parseStructuredData(rest)
+		if err != nil {
+			return msg, err
+		}
+		msg.StructuredData = sd
+		rest = rest[n:]
+	}
+
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return msg, nil
+}
+
+// parseStructuredData parses the SD-ELEMENTs at the start of s and returns
+// their params along with how much of s they took.
+func parseStructuredData(s string) (map[string]string, int, error) {
+
+	sd := map[string]string{}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+
+		// SD-ID
+		j := strings.IndexAny(s[i:], " ]")
+		if j < 0 {
+			return nil, 0, fmt.Errorf("unterminated structured data")
+		}
+		i += j
+
+		for i < len(s) && s[i] == ' ' {
+			i += 1
+			eq := strings.Index(s[i:], `="`)
+			if eq < 0 {
+				return nil, 0, fmt.Errorf("invalid structured data param")
+			}
+			name := s[i : i+eq]
+			i += eq + 2
+
+			val := bytes.Buffer{}
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i += 1
+				}
+				val.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, 0, fmt.Errorf("unterminated structured data value")
+			}
+			i += 1
+			sd[name] = val.String()
+		}
+
+		if i >= len(s) || s[i] != ']' {
+			return nil, 0, fmt.Errorf("unterminated structured data")
+		}
+		i += 1
+	}
+
+	return sd, i, nil
+}
+
+func parseRFC3164(msg syslogMessage, s string, now time.Time) syslogMessage {
+
+	if len(s) >= len(RFC3164_TIMESTAMP) {
+		if t, err := time.ParseInLocation(RFC3164_TIMESTAMP, s[:len(RFC3164_TIMESTAMP)], now.Location()); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.AddDate(0, 0, 1)) {
+				// sent in december, received in january
+				t = t.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = &t
+			s = strings.TrimPrefix(s[len(RFC3164_TIMESTAMP):], " ")
+
+			if sp := strings.IndexByte(s, ' '); sp > 0 {
+				msg.Hostname = s[:sp]
+				s = s[sp+1:]
+			}
+		}
+	}
+
+	// TAG[PID]: MSG
+	if colon := strings.Index(s, ": "); colon > 0 && !strings.ContainsAny(s[:colon], " ") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			msg.ProcId = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		msg.AppName = tag
+		s = s[colon+2:]
+	}
+
+	msg.Message = s
+	return msg
+}
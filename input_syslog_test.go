@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+
+	now := time.Date(2017, time.January, 2, 0, 0, 0, 0, time.UTC)
+
+	msg, err := parseSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appli\"cation"][examplePriority@32473 class="high"] `+"\ufeffAn application event\n"), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Facility != 20 || msg.Severity != 5 || msg.Timestamp.Format(ISO_8601) != "2003-10-11T22:14:15.003Z" ||
+		msg.Hostname != "mymachine.example.com" || msg.AppName != "evntslog" || msg.ProcId != "" || msg.MsgId != "ID47" {
+		t.Fatalf("unexpected header %+v", msg)
+	}
+	if msg.StructuredData["iut"] != "3" || msg.StructuredData["eventSource"] != `Appli"cation` || msg.StructuredData["class"] != "high" {
+		t.Fatalf("unexpected structured data %v", msg.StructuredData)
+	}
+	if msg.Message != "An application event" {
+		t.Fatalf("unexpected message %q", msg.Message)
+	}
+
+	// december messages received in january are from last year
+	msg, err = parseSyslogMessage([]byte("<34>Dec 31 23:59:59 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8"), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Facility != 4 || msg.Severity != 2 || msg.Timestamp.Format(ISO_8601) != "2016-12-31T23:59:59Z" ||
+		msg.Hostname != "mymachine" || msg.AppName != "su" || msg.ProcId != "123" || msg.Message != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Fatalf("unexpected RFC 3164 message %+v", msg)
+	}
+
+	for _, data := range []string{"no priority", "<-1>1 - - - - - -", "<+5>1 - - - - - -", "<192>1 - - - - - -"} {
+		if _, err := parseSyslogMessage([]byte(data), now); err != ErrSyslogPriority {
+			t.Fatalf("expected a priority error for %q, got %v", data, err)
+		}
+	}
+}
+
+func TestReadSyslogFrames(t *testing.T) {
+
+	input := "11 <14>1 - - -" + "<14>hello\n" + "5 <14>x"
+	frames := []string{}
+	readSyslogFrames(bufio.NewReader(strings.NewReader(input)), func(msg []byte) {
+		frames = append(frames, string(msg))
+	})
+
+	if len(frames) != 3 || frames[0] != "<14>1 - - -" || frames[1] != "<14>hello\n" || frames[2] != "<14>x" {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+}
+
+func TestSyslogRecord(t *testing.T) {
+
+	logfile := Logfile{Name: "appliance", Filename: "udp://:514"}
+	parser := NewRegexParser("", "", logfile.Filename, "pushr-host", regexp.MustCompile(`^user=(?P<user>\w+)`), testFormat)
+
+	msg, _ := parseSyslogMessage([]byte(`<11>1 2017-01-01T00:00:01Z fw-1 sshd 42 - [x@1 path="/login" user="ignored"] user=bob denied`), time.Now())
+	r := syslogRecord(logfile, parser, msg, testFormat)
+
+	attrs := r.EventAttributes
+	if attrs["user"] != "bob" || attrs["path"] != "/login" || attrs["hostname"] != "fw-1" || attrs["app"] != "sshd" ||
+		attrs["log_level"] != "err" || attrs["syslog_procid"] != "42" || attrs["event_datetime"] != "2017-01-01T00:00:01Z" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+	if r.logfile != "appliance" {
+		t.Fatalf("expected the record to come from the appliance logfile, got %s", r.logfile)
+	}
+}
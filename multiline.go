@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	MULTILINE_MAX_LINES = 500
+	MULTILINE_TIMEOUT   = 5 * time.Second
+)
+
+// applyMultiline compiles the multiline settings of a logfile.
+func (l *Logfile) applyMultiline() error {
+
+	if l.MultilinePattern == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(l.MultilinePattern)
+	if err != nil {
+		return fmt.Errorf("logfile %s has invalid multiline_pattern: %s", l.Name, err.Error())
+	}
+	l.MultilineRegex = re
+
+	switch l.MultilineMatch {
+	case "":
+		l.MultilineMatch = "after"
+	case "after", "before":
+	default:
+		return fmt.Errorf("logfile %s has unknown multiline_match %s, must be after or before", l.Name, l.MultilineMatch)
+	}
+
+	if l.MultilineTimeout != "" {
+		if _, err := time.ParseDuration(l.MultilineTimeout); err != nil {
+			return fmt.Errorf("logfile %s has invalid multiline_timeout: %s", l.Name, err.Error())
+		}
+	}
+
+	if l.BufferMultiLines {
+		return fmt.Errorf("logfile %s can't have both multiline_pattern and buffer_multi_lines", l.Name)
+	}
+	if l.ParseMode == "docker" || l.ParseMode == "cri" {
+		// the pattern would see the wrapped lines, not the messages
+		return fmt.Errorf("logfile %s can't have multiline_pattern with the %s parse_mode", l.Name, l.ParseMode)
+	}
+
+	return nil
+}
+
+// multilineBuffer puts the lines of a message back together the way
+// filebeat does. Lines that match the pattern, or don't with negate,
+// belong with the line before them when match is after, and with the line
+// after them when match is before. The first line of a message is parsed,
+// the rest are appended to its log_line.
+type multilineBuffer struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	before   bool
+	maxLines int
+	timeout  time.Duration
+
+	open   bool    // a message is being read
+	next   bool    // match before, the last line goes on in the next one
+	lines  int     // lines of the message so far
+	record *Record // record of the first line, nil when it was dropped
+	ack    func()
+}
+
+// newMultilineBuffer returns nil when the logfile has no multiline_pattern.
+func newMultilineBuffer(logfile Logfile) *multilineBuffer {
+
+	if logfile.MultilineRegex == nil {
+		return nil
+	}
+
+	m := &multilineBuffer{
+		pattern:  logfile.MultilineRegex,
+		negate:   logfile.MultilineNegate,
+		before:   logfile.MultilineMatch == "before",
+		maxLines: logfile.MultilineMaxLines,
+		timeout:  MULTILINE_TIMEOUT,
+	}
+	if m.maxLines <= 0 {
+		m.maxLines = MULTILINE_MAX_LINES
+	}
+	if d, err := time.ParseDuration(logfile.MultilineTimeout); err == nil && d > 0 {
+		m.timeout = d
+	}
+
+	return m
+}
+
+func (m *multilineBuffer) matches(line string) bool {
+	return m.pattern.MatchString(line) != m.negate
+}
+
+// continues is true when line belongs to the message being read.
+func (m *multilineBuffer) continues(line string) bool {
+	if !m.open {
+		return false
+	}
+	if m.before {
+		return m.next
+	}
+	return m.matches(line)
+}
+
+// start begins a message with its first line. keep sets its record once
+// the line has been parsed.
+func (m *multilineBuffer) start(line string) {
+	m.open = true
+	m.next = m.before && m.matches(line)
+	m.lines = 1
+	m.record = nil
+	m.ack = nil
+}
+
+func (m *multilineBuffer) keep(record *Record, ack func()) {
+	m.record = record
+	m.ack = ack
+}
+
+// append adds a line to the message. Lines past max_lines are dropped.
+func (m *multilineBuffer) append(line string) {
+
+	m.lines += 1
+	if m.before {
+		m.next = m.matches(line)
+	}
+	if m.record == nil || m.lines > m.maxLines {
+		return
+	}
+
+	logLine := m.record.EventAttributes["log_line"]
+	if isUnset(logLine) {
+		m.record.EventAttributes["log_line"] = line
+	} else {
+		m.record.EventAttributes["log_line"] = logLine + "\n" + line
+	}
+	m.record.rawLine += "\n" + line
+}
+
+// complete is true when no more lines can be added to the message. With
+// match after that's only known once the next message starts.
+func (m *multilineBuffer) complete() bool {
+	return m.open && m.before && !m.next
+}
+
+// take ends the message and returns its record, nil if there's none.
+func (m *multilineBuffer) take() (*Record, func()) {
+	record, ack := m.record, m.ack
+	m.open = false
+	m.next = false
+	m.lines = 0
+	m.record = nil
+	m.ack = nil
+	return record, ack
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMonitorFileMultiline(t *testing.T) {
+
+	data := "2017-01-02 03:04:05 ERROR request failed\n" +
+		"java.lang.IllegalStateException: closed\n" +
+		"\tat com.example.Pool.get(Pool.java:42)\n" +
+		"\tat com.example.Main.main(Main.java:12)\n" +
+		"2017-01-02 03:04:06 INFO retrying\n" +
+		"2017-01-02 03:04:07 WARN slow\n" +
+		"\tat com.example.Main.main(Main.java:13)\n"
+
+	logfile := Logfile{
+		Name:             "app",
+		StreamName:       "app",
+		ParseMode:        "regex",
+		LineRegex:        `^(?P<event_datetime>\S+ \S+) (?P<log_level>\w+) `,
+		TimeFormat:       "2006-01-02 15:04:05",
+		MultilinePattern: `^\d{4}-\d{2}-\d{2} `,
+		MultilineNegate:  true,
+	}
+	if err := logfile.applyMultiline(); err != nil {
+		t.Fatal(err.Error())
+	}
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, logfile, stream, data, false)
+
+	expected := []string{
+		"request failed\njava.lang.IllegalStateException: closed\n\tat com.example.Pool.get(Pool.java:42)\n\tat com.example.Main.main(Main.java:12)",
+		"retrying",
+		"slow\n\tat com.example.Main.main(Main.java:13)",
+	}
+	if len(stream.records) != len(expected) {
+		t.Fatalf("expected %d records, got %d %v", len(expected), len(stream.records), stream.records)
+	}
+	for i, logLine := range expected {
+		if stream.records[i].EventAttributes["log_line"] != logLine {
+			t.Errorf("expected log_line %q, got %q", logLine, stream.records[i].EventAttributes["log_line"])
+		}
+	}
+	if stream.records[0].EventAttributes["log_level"] != "ERROR" {
+		t.Errorf("expected the attributes of the first line, got %v", stream.records[0].EventAttributes)
+	}
+
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("expected the checkpoint at the end of the file, got %+v", last.Checkpoint)
+	}
+}
+
+func TestMultilineBuffer(t *testing.T) {
+
+	// lines ending in \ go on in the next one, only 3 lines are kept
+	m := newMultilineBuffer(Logfile{
+		MultilineRegex:    regexp.MustCompile(`\\$`),
+		MultilineMatch:    "before",
+		MultilineMaxLines: 3,
+	})
+
+	lines := []string{"one \\", "two \\", "three \\", "four", "five"}
+
+	m.start(lines[0])
+	m.keep(NewRecord(lines[0], nil, map[string]string{"log_line": lines[0]}), nil)
+	for _, line := range lines[1:4] {
+		if !m.continues(line) {
+			t.Fatalf("expected %q to continue the message", line)
+		}
+		m.append(line)
+	}
+	if !m.complete() || m.continues(lines[4]) {
+		t.Fatalf("expected the message to end at %q", lines[3])
+	}
+
+	record, _ := m.take()
+	if record == nil || record.EventAttributes["log_line"] != "one \\\ntwo \\\nthree \\" {
+		t.Fatalf("unexpected message %v", record)
+	}
+	if m.continues(lines[4]) {
+		t.Fatalf("expected no message after take")
+	}
+
+	for _, logfile := range []Logfile{
+		{Name: "a", MultilinePattern: `(`},
+		{Name: "b", MultilinePattern: `^\s`, MultilineMatch: "around"},
+		{Name: "c", MultilinePattern: `^\s`, BufferMultiLines: true},
+		{Name: "d", MultilinePattern: `^\s`, ParseMode: "cri"},
+	} {
+		if err := logfile.applyMultiline(); err == nil {
+			t.Errorf("expected an error for logfile %s", logfile.Name)
+		}
+	}
+}
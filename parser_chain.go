@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// hits of the parsers of every chain, by logfile name. the files of
+	// a directory share their counters.
+	gParserHits      = make(map[string]map[string]*uint64)
+	gParserHitsMutex = new(sync.Mutex)
+)
+
+// ParserConfig is one parser of a chain. Settings it doesn't have are the
+// logfile's, so a chain can be as short as parse_mode: [json, regex, raw].
+type ParserConfig struct {
+	Name          string            `yaml:"name" json:"name,omitempty"`
+	ParseMode     string            `yaml:"parse_mode" json:"parse_mode,omitempty"`
+	Preset        string            `yaml:"preset" json:"preset,omitempty"`
+	LineRegex     string            `yaml:"line_regex" json:"line_regex,omitempty"`
+	TimeFormat    string            `yaml:"time_format" json:"time_format,omitempty"`
+	FieldMappings map[string]string `yaml:"field_mappings" json:"field_mappings,omitempty"`
+	ParserOptions []string          `yaml:"parser_options" json:"parser_options,omitempty"`
+}
+
+// UnmarshalYAML takes a plain parse mode as well as a full parser config.
+func (c *ParserConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var mode string
+	if err := unmarshal(&mode); err == nil {
+		c.ParseMode = mode
+		return nil
+	}
+
+	type plainParserConfig ParserConfig
+	return unmarshal((*plainParserConfig)(c))
+}
+
+// ChainParser tries its parsers in order, the first one that parses a line
+// wins and its name goes in the parser attribute.
+type ChainParser struct {
+	names       []string
+	parsers     []Parser
+	timeFormats []string
+	timeFormat  string
+	hits        []*uint64
+}
+
+func newChainParser(logfile Logfile, stream Streamer) *ChainParser {
+
+	_, _, _, fatalf := LogFuncs(logfile)
+
+	p := &ChainParser{timeFormat: logfile.TimeFormat}
+	for _, c := range logfile.Parsers {
+
+		l := logfile
+		l.Parsers = nil
+		l.ParseMode = c.ParseMode
+
+		if c.Preset != "" {
+			// presets don't take the settings meant for other parsers
+			l.Preset, l.LineRegex, l.TimeFormat, l.FieldMappings = c.Preset, "", "", nil
+		}
+		if c.LineRegex != "" {
+			l.LineRegex = c.LineRegex
+			l.Regex = nil
+		}
+		if c.TimeFormat != "" {
+			l.TimeFormat = c.TimeFormat
+		}
+		if c.FieldMappings != nil {
+			l.FieldMappings = withMappings(l.FieldMappings, c.FieldMappings)
+		}
+		if c.ParserOptions != nil {
+			l.ParserOptions = c.ParserOptions
+		}
+		if err := l.applyPreset(); err != nil {
+			fatalf(err.Error())
+		}
+		l.applyContainerDefaults()
+
+		name := c.Name
+		if name == "" {
+			name = c.Preset
+		}
+		if name == "" {
+			name = l.ParseMode
+		}
+
+		p.names = append(p.names, name)
+		p.parsers = append(p.parsers, newParser(l, stream))
+		p.timeFormats = append(p.timeFormats, l.TimeFormat)
+	}
+
+	if len(p.parsers) == 0 {
+		fatalf("parse_mode needs at least one parser")
+	}
+
+	p.hits = parserHitCounters(logfile.Name, p.names)
+	return p
+}
+
+// parserHitCounters returns the counters of a logfile's parsers.
+func parserHitCounters(logfileName string, names []string) []*uint64 {
+
+	gParserHitsMutex.Lock()
+	defer gParserHitsMutex.Unlock()
+
+	counters, ok := gParserHits[logfileName]
+	if !ok {
+		counters = make(map[string]*uint64)
+		gParserHits[logfileName] = counters
+	}
+
+	hits := []*uint64{}
+	for _, name := range names {
+		if _, ok := counters[name]; !ok {
+			counters[name] = new(uint64)
+		}
+		hits = append(hits, counters[name])
+	}
+	return hits
+}
+
+// ParserHits returns how many lines each parser of every chain parsed,
+// by logfile name.
+func ParserHits() map[string]map[string]uint64 {
+
+	gParserHitsMutex.Lock()
+	defer gParserHitsMutex.Unlock()
+
+	hits := make(map[string]map[string]uint64)
+	for logfileName, counters := range gParserHits {
+		hits[logfileName] = make(map[string]uint64)
+		for name, counter := range counters {
+			hits[logfileName][name] = atomic.LoadUint64(counter)
+		}
+	}
+	return hits
+}
+
+func (p *ChainParser) Init(defaults, fieldMappings map[string]string, FieldsOrder []string, defaultTable []Attribute) {
+}
+
+func (p *ChainParser) GetTable() []Attribute {
+	return p.parsers[0].GetTable()
+}
+
+func (p *ChainParser) Defaults() map[string]string {
+	return p.parsers[0].Defaults()
+}
+
+func (p *ChainParser) Parse(line string) (map[string]string, error) {
+
+	for i, parser := range p.parsers {
+		result, err := parser.Parse(line)
+		if err != nil {
+			continue
+		}
+
+		atomic.AddUint64(p.hits[i], 1)
+		result["parser"] = p.names[i]
+
+		// processLine reads event_datetime with the logfile's time_format
+		if p.timeFormats[i] != p.timeFormat {
+			if t, err := parseTimestamp(result["event_datetime"], p.timeFormats[i]); err == nil && t != nil {
+				if p.timeFormat == "epochmillisecs" {
+					result["event_datetime"] = strconv.FormatInt(t.UnixNano()/int64(1000000), 10)
+				} else {
+					result["event_datetime"] = t.Format(p.timeFormat)
+				}
+			}
+		}
+
+		return result, nil
+	}
+
+	return nil, ErrParseNotMatched
+}
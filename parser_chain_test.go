@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var chainTestConfig = `
+files:
+  - name: api
+    file: /var/log/api.log
+    stream: app-log
+    time_format: 2006-01-02T15:04:05.999Z
+    field_mappings:
+      log_level: level
+    parse_mode:
+      - json
+      - name: banner
+        parse_mode: regex
+        line_regex: '^(?P<event_datetime>\S+ \S+) starting (?P<app>\w+)'
+        time_format: 2006-01-02 15:04:05
+      - raw
+  - name: web
+    file: /var/log/web.log
+    parse_mode: regex
+    line_regex: '^(?P<log_level>\w+)'
+`
+
+func TestChainParser(t *testing.T) {
+
+	config := parseYamlConfig(strings.NewReader(chainTestConfig))
+	if len(config.Logfiles) != 2 || len(config.Logfiles[0].Parsers) != 3 || config.Logfiles[0].ParseMode != "" ||
+		config.Logfiles[0].Name != "api" || config.Logfiles[0].FieldMappings["log_level"] != "level" {
+		t.Fatalf("unexpected chain config %+v", config.Logfiles[0])
+	}
+	if config.Logfiles[1].ParseMode != "regex" || len(config.Logfiles[1].Parsers) != 0 {
+		t.Fatalf("a single parse_mode must stay as is, got %+v", config.Logfiles[1])
+	}
+
+	// the hits of earlier runs of the test would add up
+	gParserHitsMutex.Lock()
+	delete(gParserHits, "api")
+	gParserHitsMutex.Unlock()
+
+	logfile := config.Logfiles[0]
+	parser := newParser(logfile, &testStream{format: testFormat})
+
+	for _, test := range []struct {
+		line, parser, attribute, value string
+	}{
+		{`{"level":"warn","msg":"slow"}`, "json", "log_level", "warn"},
+		{`2017-01-02 03:04:05 starting api`, "banner", "event_datetime", "2017-01-02T03:04:05Z"},
+		{`    at com.example.Main(Main.java:12)`, "raw", "log_line", "at com.example.Main(Main.java:12)"},
+	} {
+		record, _ := processLine(logfile, parser, test.line, testFormat)
+		if record == nil {
+			t.Fatalf("expected %q to be parsed", test.line)
+		}
+		if record.EventAttributes["parser"] != test.parser || record.EventAttributes[test.attribute] != test.value {
+			t.Errorf("expected %s to parse %q with %s=%s, got %v", test.parser, test.line, test.attribute, test.value, record.EventAttributes)
+		}
+	}
+
+	hits := ParserHits()["api"]
+	if hits["json"] != 1 || hits["banner"] != 1 || hits["raw"] != 1 {
+		t.Fatalf("unexpected hits %v", hits)
+	}
+}
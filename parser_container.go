@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CONTAINER_MAX_MESSAGE     = 1 << 20 // 1MB, a longer message is sent in parts
+	CONTAINER_PARTIAL_TIMEOUT = time.Second * 5
+)
+
+var (
+	// /var/log/containers/<pod>_<namespace>_<container>-<id>.log
+	kubernetesLogFilename = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+
+	ErrContainerLogFormat = errors.New("not a container log line")
+)
+
+// partialParser is implemented by parsers of formats that split long
+// messages over several lines.
+type partialParser interface {
+	// Partial buffers the line and returns true when it's only part of a
+	// message, Parse of the line that ends the message returns all of it.
+	Partial(line string) bool
+	// Pending is true while there are buffered parts.
+	Pending() bool
+	// Flush returns a line ending each message with buffered parts, for
+	// when the line with the last part doesn't come.
+	Flush() []string
+}
+
+type containerLogEntry struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// ContainerParser parses the docker json-file format and the CRI format
+// containerd and cri-o write. On kubernetes nodes the pod, namespace and
+// container come from the filename.
+type ContainerParser struct {
+	App       string
+	AppVer    string
+	Filename  string
+	Hostname  string
+	Table     []Attribute
+	cri       bool
+	podFields map[string]string
+	partial   map[string]*bytes.Buffer // by stream, stdout and stderr interleave
+	lastTime  map[string]string        // of the last buffered part of a stream
+}
+
+func NewContainerParser(app, appVer, filename, hostname string, cri bool, defaultTable []Attribute) *ContainerParser {
+
+	podFields := map[string]string{}
+	if m := kubernetesLogFilename.FindStringSubmatch(filepath.Base(filename)); m != nil {
+		podFields["pod_name"] = m[1]
+		podFields["namespace"] = m[2]
+		podFields["container_name"] = m[3]
+		podFields["container_id"] = m[4]
+	}
+
+	return &ContainerParser{
+		App:       app,
+		AppVer:    appVer,
+		Filename:  filename,
+		Hostname:  hostname,
+		Table:     defaultTable,
+		cri:       cri,
+		podFields: podFields,
+		partial:   make(map[string]*bytes.Buffer),
+		lastTime:  make(map[string]string),
+	}
+}
+
+func (p *ContainerParser) Init(defaults, fieldMappings map[string]string, FieldsOrder []string, defaultTable []Attribute) {
+}
+
+func (p *ContainerParser) GetTable() []Attribute {
+	return p.Table
+}
+
+func (p *ContainerParser) Defaults() map[string]string {
+
+	d := make(map[string]string)
+	for _, k := range p.Table {
+		d[k.Key] = "\\N"
+	}
+
+	d["app"] = p.App
+	d["app_ver"] = p.AppVer
+	d["filename"] = p.Filename
+	d["hostname"] = p.Hostname
+	d["ingest_datetime"] = time.Now().UTC().Format(ISO_8601)
+
+	return d
+}
+
+// entry decodes a line, partial is true for the lines of a split message.
+func (p *ContainerParser) entry(line string) (containerLogEntry, bool, error) {
+
+	entry := containerLogEntry{}
+
+	if p.cri {
+		// <time> <stream> <P|F> <msg>
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 {
+			return entry, false, ErrContainerLogFormat
+		}
+		entry.Time, entry.Stream = fields[0], fields[1]
+		if len(fields) == 4 {
+			entry.Log = fields[3]
+		}
+		tag := strings.SplitN(fields[2], ":", 2)[0]
+		if tag != "P" && tag != "F" {
+			return entry, false, ErrContainerLogFormat
+		}
+		return entry, tag == "P", nil
+	}
+
+	// docker splits messages over 16KB, only the last part ends with \n
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return entry, false, err
+	}
+	if entry.Time == "" {
+		return entry, false, ErrContainerLogFormat
+	}
+	return entry, !strings.HasSuffix(entry.Log, "\n"), nil
+}
+
+func (p *ContainerParser) Partial(line string) bool {
+
+	entry, partial, err := p.entry(line)
+	if err != nil || !partial {
+		return false
+	}
+
+	buf, ok := p.partial[entry.Stream]
+	if !ok {
+		buf = &bytes.Buffer{}
+		p.partial[entry.Stream] = buf
+	}
+	if buf.Len()+len(entry.Log) > CONTAINER_MAX_MESSAGE {
+		// too long, this part ends the message
+		return false
+	}
+	buf.WriteString(entry.Log)
+	p.lastTime[entry.Stream] = entry.Time
+	return true
+}
+
+func (p *ContainerParser) Pending() bool {
+	for _, buf := range p.partial {
+		if buf.Len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ContainerParser) Flush() []string {
+
+	streams := []string{}
+	for stream, buf := range p.partial {
+		if buf.Len() > 0 {
+			streams = append(streams, stream)
+		}
+	}
+	sort.Strings(streams)
+
+	lines := []string{}
+	for _, stream := range streams {
+		if p.cri {
+			lines = append(lines, p.lastTime[stream]+" "+stream+" F ")
+			continue
+		}
+		line, _ := json.Marshal(containerLogEntry{Log: "\n", Stream: stream, Time: p.lastTime[stream]})
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+func (p *ContainerParser) Parse(line string) (map[string]string, error) {
+
+	entry, _, err := p.entry(line)
+	if err != nil {
+		return nil, err
+	}
+
+	message := entry.Log
+	if buf, ok := p.partial[entry.Stream]; ok && buf.Len() > 0 {
+		message = buf.String() + message
+		buf.Reset()
+	}
+
+	result := p.Defaults()
+	for k, v := range p.podFields {
+		result[k] = v
+	}
+	result["stream"] = entry.Stream
+	result["event_datetime"] = entry.Time
+	result["log_line"] = strings.TrimRight(message, "\r\n")
+
+	return result, nil
+}
+
+// applyContainerDefaults sets the time_format container runtimes write
+// when the config doesn't have one.
+func (l *Logfile) applyContainerDefaults() {
+	if (l.ParseMode == "docker" || l.ParseMode == "cri") && l.TimeFormat == "" {
+		l.TimeFormat = time.RFC3339Nano
+	}
+}
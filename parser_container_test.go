@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const containerTestFilename = "/var/log/containers/web-7d9f8_default_nginx-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.log"
+
+func TestDockerParser(t *testing.T) {
+
+	p := NewContainerParser("", "", containerTestFilename, "node-1", false, testFormat)
+
+	lines := []string{
+		`{"log":"first part ","stream":"stdout","time":"2019-01-02T03:04:05.123456789Z"}`,
+		`{"log":"an error\n","stream":"stderr","time":"2019-01-02T03:04:05.2Z"}`,
+		`{"log":"second part\n","stream":"stdout","time":"2019-01-02T03:04:05.3Z"}`,
+	}
+
+	if !p.Partial(lines[0]) || !p.Pending() {
+		t.Fatal("expected the first line to be buffered")
+	}
+
+	if p.Partial(lines[1]) {
+		t.Fatal("expected a complete stderr line")
+	}
+	result, err := p.Parse(lines[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result["log_line"] != "an error" || result["stream"] != "stderr" {
+		t.Fatalf("stderr must not get the stdout part, got %v", result)
+	}
+
+	if p.Partial(lines[2]) {
+		t.Fatal("expected the last part to end the message")
+	}
+	result, err = p.Parse(lines[2])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result["log_line"] != "first part second part" || result["event_datetime"] != "2019-01-02T03:04:05.3Z" || p.Pending() {
+		t.Fatalf("unexpected reassembled message %v", result)
+	}
+	if result["pod_name"] != "web-7d9f8" || result["namespace"] != "default" || result["container_name"] != "nginx" {
+		t.Fatalf("unexpected pod attributes %v", result)
+	}
+}
+
+func TestCRIParser(t *testing.T) {
+
+	p := NewContainerParser("", "", containerTestFilename, "node-1", true, testFormat)
+
+	if !p.Partial("2016-10-06T00:17:09.669794202Z stdout P part one,") {
+		t.Fatal("expected a P line to be buffered")
+	}
+	line := "2016-10-06T00:17:09.669794203Z stdout F  part two"
+	if p.Partial(line) {
+		t.Fatal("expected an F line to end the message")
+	}
+	result, err := p.Parse(line)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result["log_line"] != "part one, part two" || result["stream"] != "stdout" {
+		t.Fatalf("unexpected message %v", result)
+	}
+
+	if _, err := p.Parse("not a cri line"); err == nil {
+		t.Fatal("expected an error for a line without a tag")
+	}
+}
+
+func TestMonitorFileContainerParts(t *testing.T) {
+
+	data := "2016-10-06T00:17:09.669794202Z stdout P part one,\n" +
+		"2016-10-06T00:17:09.669794203Z stdout F  part two\n"
+
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, Logfile{Name: "containers", StreamName: "containers", ParseMode: "cri", TimeFormat: time.RFC3339Nano}, stream, data, false)
+
+	if len(stream.records) != 1 || stream.records[0].EventAttributes["log_line"] != "part one, part two" {
+		t.Fatalf("expected one reassembled record, got %d %v", len(stream.records), stream.records)
+	}
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("expected the checkpoint at the end of the file, got %+v", last.Checkpoint)
+	}
+}
+
+func TestContainerParserFlush(t *testing.T) {
+
+	for _, test := range []struct {
+		cri  bool
+		line string
+	}{
+		{false, `{"log":"foo","stream":"stdout","time":"2019-01-02T03:04:05.1Z"}`},
+		{true, "2019-01-02T03:04:05.1Z stdout P foo"},
+	} {
+		p := NewContainerParser("", "", containerTestFilename, "node-1", test.cri, testFormat)
+		if !p.Partial(test.line) {
+			t.Fatalf("expected %s to be buffered", test.line)
+		}
+
+		lines := p.Flush()
+		if len(lines) != 1 {
+			t.Fatalf("expected a line ending the message, got %q", lines)
+		}
+		result, err := p.Parse(lines[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if result["log_line"] != "foo" || result["event_datetime"] != "2019-01-02T03:04:05.1Z" || p.Pending() {
+			t.Fatalf("unexpected flushed message %v", result)
+		}
+	}
+}
+
+func TestMonitorFileContainerPartAtEOF(t *testing.T) {
+
+	// the output of printf foo never gets a \n
+	data := `{"log":"done\n","stream":"stdout","time":"2019-01-02T03:04:05.1Z"}` + "\n" +
+		`{"log":"foo","stream":"stdout","time":"2019-01-02T03:04:05.2Z"}` + "\n"
+
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, Logfile{Name: "containers", StreamName: "containers", ParseMode: "docker", TimeFormat: time.RFC3339Nano}, stream, data, false)
+
+	if len(stream.records) != 2 || stream.records[1].EventAttributes["log_line"] != "foo" {
+		t.Fatalf("expected the unfinished message at the end of the file, got %d %v", len(stream.records), stream.records)
+	}
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("expected the checkpoint at the end of the file, got %+v", last.Checkpoint)
+	}
+}
+
+func TestMonitorFileSkippedContainerParts(t *testing.T) {
+
+	data := "2016-10-06T00:17:09.669794202Z stdout P GET \n" +
+		"2016-10-06T00:17:09.669794203Z stdout F /health\n"
+
+	defer func(threshold time.Time) { gTimeThreshold = threshold }(gTimeThreshold)
+	gTimeThreshold = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the checkpoint has to move past the skipped message without
+	// waiting for another line
+	stream := &testStream{format: testFormat}
+	last := monitorTestFile(t, Logfile{Name: "containers", StreamName: "containers", ParseMode: "cri", TimeFormat: time.RFC3339Nano}, stream, data, true)
+
+	if len(stream.records) != 0 {
+		t.Fatalf("expected the message to be skipped, got %v", stream.records)
+	}
+	if last.Checkpoint == nil || last.Checkpoint.Offset != int64(len(data)) {
+		t.Fatalf("checkpoint held back by the skipped message, got %+v", last.Checkpoint)
+	}
+}
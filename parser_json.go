@@ -10,6 +10,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
 	"strings"
 	"time"
 
@@ -61,26 +64,28 @@ func (p *JSONParser) Defaults() map[string]string {
 }
 
 func (p *JSONParser) Parse(line string) (map[string]string, error) {
-	// By default, Go treats numeric values in JSON as float64
-	// this will result in loss of precision for 'bigint'
-	// TODO: Implement a json.NewDecoder() w/ decoder.UseNumber()
 
-	matches := make(map[string]interface{})
+	// numbers are kept as json.Number so bigint ids don't go through
+	// float64 and lose precision
+	matches, err := decodeJSONObject(line)
 	result := p.Defaults()
-	err := json.Unmarshal([]byte(line), &matches)
 	if err != nil {
 		return result, err
 	}
 
+	// everything is looked up before anything is deleted, paths like
+	// request and request.id would depend on the map order otherwise
 	for k, v := range p.FieldMappings {
-		if inf, ok := matches[v]; ok {
+		if inf, ok := lookupJSONPath(matches, v); ok {
 			s, err := interfaceToString(inf)
 			if err != nil {
 				log.Warn(err.Error())
 			}
 			result[k] = s
 		}
-		delete(matches, v)
+	}
+	for _, v := range p.FieldMappings {
+		deleteJSONPath(matches, v)
 	}
 
 	cleanLogLine := line
@@ -93,3 +98,133 @@ func (p *JSONParser) Parse(line string) (map[string]string, error) {
 	return result, err
 
 }
+
+func decodeJSONObject(line string) (map[string]interface{}, error) {
+
+	matches := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&matches); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the json object")
+	}
+
+	return matches, nil
+}
+
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath splits a path like request.headers.user-agent or tags[0]
+// into the keys and indexes to follow.
+func parseJSONPath(path string) ([]jsonPathStep, bool) {
+
+	steps := []jsonPathStep{}
+	for _, part := range strings.Split(path, ".") {
+
+		key := part
+		indexes := ""
+		if open := strings.IndexByte(part, '['); open >= 0 {
+			key, indexes = part[:open], part[open:]
+		}
+		if key != "" {
+			steps = append(steps, jsonPathStep{key: key})
+		} else if indexes == "" {
+			return nil, false
+		}
+
+		for indexes != "" {
+			end := strings.IndexByte(indexes, ']')
+			if indexes[0] != '[' || end < 0 {
+				return nil, false
+			}
+			i, err := strconv.Atoi(indexes[1:end])
+			if err != nil || i < 0 {
+				return nil, false
+			}
+			steps = append(steps, jsonPathStep{index: i, isIndex: true})
+			indexes = indexes[end+1:]
+		}
+	}
+
+	return steps, len(steps) > 0
+}
+
+// lookupJSONPath returns the value at path. A top level key with the exact
+// name wins, so keys that have dots in them still map.
+func lookupJSONPath(doc map[string]interface{}, path string) (interface{}, bool) {
+
+	if v, ok := doc[path]; ok {
+		return v, true
+	}
+
+	steps, ok := parseJSONPath(path)
+	if !ok {
+		return nil, false
+	}
+
+	var current interface{} = doc
+	for _, step := range steps {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if step.isIndex {
+				return nil, false
+			}
+			if current, ok = node[step.key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if !step.isIndex || step.index >= len(node) {
+				return nil, false
+			}
+			current = node[step.index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// deleteJSONPath removes a mapped value so it isn't in log_line twice.
+// Array elements are left alone, removing one would shift the others.
+func deleteJSONPath(doc map[string]interface{}, path string) {
+
+	if _, ok := doc[path]; ok {
+		delete(doc, path)
+		return
+	}
+
+	steps, ok := parseJSONPath(path)
+	if !ok || steps[len(steps)-1].isIndex {
+		return
+	}
+
+	parentPath := steps[:len(steps)-1]
+	var parent interface{} = doc
+	for _, step := range parentPath {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if step.isIndex {
+				return
+			}
+			parent = node[step.key]
+		case []interface{}:
+			if !step.isIndex || step.index >= len(node) {
+				return
+			}
+			parent = node[step.index]
+		default:
+			return
+		}
+	}
+
+	if node, ok := parent.(map[string]interface{}); ok {
+		delete(node, steps[len(steps)-1].key)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJSONParserPaths(t *testing.T) {
+
+	p := NewJSONParser("app", "1", "app.log", "host", map[string]string{
+		"user_agent":     "request.headers.user-agent",
+		"user_tag":       "user.id",
+		"device_tag":     "tags[0]",
+		"country":        "geo",
+		"language":       "locale.name",
+		"response_bytes": "matrix[1][0]",
+		"remote_address": "client.ip",
+	}, testFormat)
+
+	result, err := p.Parse(`{"request":{"headers":{"user-agent":"curl/7.51.0","accept":"*/*"}},"user":{"id":9007199254740993},` +
+		`"tags":["a","b"],"geo":{"country":"US","city":"SF"},"matrix":[[1],[2]],"client.ip":"10.0.0.1","size":12345678901234567890}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := map[string]string{
+		"user_agent":     "curl/7.51.0",
+		"user_tag":       "9007199254740993",
+		"device_tag":     "a",
+		"country":        `{"city":"SF","country":"US"}`,
+		"response_bytes": "2",
+		"remote_address": "10.0.0.1",
+	}
+	for k, v := range want {
+		if result[k] != v {
+			t.Errorf("expected %s to be %s, got %s", k, v, result[k])
+		}
+	}
+
+	if _, ok := result["language"]; ok {
+		t.Error("a missing path must not set the attribute")
+	}
+
+	// mapped values are taken out of log_line, array elements stay
+	wantLogLine := `{"matrix":[[1],[2]],"request":{"headers":{"accept":"*/*"}},"size":12345678901234567890,"tags":["a","b"],"user":{}}`
+	if result["log_line"] != wantLogLine {
+		t.Errorf("expected log_line %s, got %s", wantLogLine, result["log_line"])
+	}
+
+	if _, err := p.Parse(`{"a":1} trailing`); err == nil {
+		t.Error("expected an error for data after the object")
+	}
+
+	// overlapping paths get the values of the whole line, whatever the
+	// order the mappings are gone through in
+	p = NewJSONParser("app", "1", "app.log", "host", map[string]string{
+		"user_tag":   "user.id",
+		"user_agent": "user",
+		"device_tag": "user.device.id",
+	}, testFormat)
+	for i := 0; i < 20; i++ {
+		result, _ := p.Parse(`{"user":{"id":7,"device":{"id":"d1"}},"msg":"hi"}`)
+		if result["user_tag"] != "7" || result["device_tag"] != "d1" || result["user_agent"] != `{"device":{"id":"d1"},"id":7}` ||
+			result["log_line"] != `{"msg":"hi"}` {
+			t.Fatalf("unexpected overlapping mappings %v", result)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+
+	for _, path := range []string{"a..b", "a[x]", "a[1", "[-1]", ""} {
+		if _, ok := parseJSONPath(path); ok {
+			t.Errorf("expected %q to be an invalid path", path)
+		}
+	}
+
+	steps, ok := parseJSONPath("a.b[2][3].c")
+	if !ok || len(steps) != 5 || steps[1].key != "b" || steps[2].index != 2 || !steps[3].isIndex || steps[4].key != "c" {
+		t.Fatalf("unexpected steps %+v", steps)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrLogfmtNoPairs = errors.New("no key=value pairs in line")
+
+// LogfmtParser parses logfmt lines: level=info msg="hello world" dur=12ms.
+// Mapped keys become attributes, the rest go to log_line as a json object.
+type LogfmtParser struct {
+	App           string
+	AppVer        string
+	Filename      string
+	Hostname      string
+	FieldMappings map[string]string
+	Table         []Attribute
+}
+
+func NewLogfmtParser(app, appVer, filename, hostname string, fieldMappings map[string]string, defaultTable []Attribute) *LogfmtParser {
+	return &LogfmtParser{
+		App:           app,
+		AppVer:        appVer,
+		Filename:      filename,
+		Hostname:      hostname,
+		FieldMappings: fieldMappings,
+		Table:         defaultTable,
+	}
+}
+
+func (p *LogfmtParser) Init(defaults, fieldMappings map[string]string, FieldsOrder []string, defaultTable []Attribute) {
+}
+
+func (p *LogfmtParser) GetTable() []Attribute {
+	return p.Table
+}
+
+func (p *LogfmtParser) Defaults() map[string]string {
+
+	d := make(map[string]string)
+	for _, k := range p.Table {
+		d[k.Key] = "\\N"
+	}
+
+	d["app"] = p.App
+	d["app_ver"] = p.AppVer
+	d["filename"] = p.Filename
+	d["hostname"] = p.Hostname
+	d["ingest_datetime"] = time.Now().UTC().Format(ISO_8601)
+
+	return d
+}
+
+func (p *LogfmtParser) Parse(line string) (map[string]string, error) {
+
+	matches, err := parseLogfmt(line)
+	if err != nil {
+		return nil, err
+	}
+
+	result := p.Defaults()
+	for k, v := range p.FieldMappings {
+		if value, ok := matches[v]; ok {
+			if isNull(value) {
+				result[k] = "\\N"
+			} else {
+				result[k] = value
+			}
+		}
+		delete(matches, v)
+	}
+
+	cleanLogLine := ""
+	if len(matches) > 0 {
+		if newJson, err := json.Marshal(matches); err == nil {
+			cleanLogLine = string(newJson)
+		}
+	}
+	result["log_line"] = cleanLogLine
+
+	return result, nil
+}
+
+// parseLogfmt splits a line into its pairs. Values are quoted with escapes
+// or run up to the next space, a bare key is true. A line without a single
+// key=value pair isn't logfmt.
+func parseLogfmt(line string) (map[string]string, error) {
+
+	pairs := make(map[string]string)
+	hasValue := false
+
+	i := 0
+	for {
+		for i < len(line) && line[i] <= ' ' {
+			i += 1
+		}
+		if i >= len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i += 1
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected %q at %d", line[i], i)
+		}
+		key := line[start:i]
+
+		if i >= len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil, fmt.Errorf("unexpected %q at %d", line[i], i)
+			}
+			pairs[key] = "true"
+			continue
+		}
+		i += 1
+		hasValue = true
+
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end += 1
+				}
+				end += 1
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated value for %s", key)
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %s", key, err.Error())
+			}
+			pairs[key] = value
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] > ' ' {
+			i += 1
+		}
+		pairs[key] = line[start:i]
+	}
+
+	if !hasValue {
+		return nil, ErrLogfmtNoPairs
+	}
+	return pairs, nil
+}
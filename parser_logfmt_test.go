@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogfmt(t *testing.T) {
+
+	pairs, err := parseLogfmt(`level=info msg="hello \"world\"\n" dur=12ms  debug empty= path=/a=b`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]string{
+		"level": "info",
+		"msg":   "hello \"world\"\n",
+		"dur":   "12ms",
+		"debug": "true",
+		"empty": "",
+		"path":  "/a=b",
+	}
+	if !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("expected %v, got %v", want, pairs)
+	}
+
+	for _, line := range []string{`just some text`, `msg="unterminated`, `="no key"`, ``} {
+		if _, err := parseLogfmt(line); err == nil {
+			t.Errorf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestLogfmtParser(t *testing.T) {
+
+	p := NewLogfmtParser("app", "1", "app.log", "host", map[string]string{"log_level": "level", "app": "service"}, testFormat)
+
+	result, err := p.Parse(`level=warn service=api msg="slow request" dur=1.2s`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result["log_level"] != "warn" || result["app"] != "api" || result["hostname"] != "host" {
+		t.Fatalf("unexpected attributes %v", result)
+	}
+	if result["log_line"] != `{"dur":"1.2s","msg":"slow request"}` {
+		t.Fatalf("expected the leftover keys as json, got %s", result["log_line"])
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// RawParser takes every line as is into log_line. At the end of a parser
+// chain it catches what the other parsers couldn't parse.
+type RawParser struct {
+	App      string
+	AppVer   string
+	Filename string
+	Hostname string
+	Table    []Attribute
+}
+
+func NewRawParser(app, appVer, filename, hostname string, defaultTable []Attribute) *RawParser {
+	return &RawParser{
+		App:      app,
+		AppVer:   appVer,
+		Filename: filename,
+		Hostname: hostname,
+		Table:    defaultTable,
+	}
+}
+
+func (p *RawParser) Init(defaults, fieldMappings map[string]string, FieldsOrder []string, defaultTable []Attribute) {
+}
+
+func (p *RawParser) GetTable() []Attribute {
+	return p.Table
+}
+
+func (p *RawParser) Defaults() map[string]string {
+
+	d := make(map[string]string)
+	for _, k := range p.Table {
+		d[k.Key] = "\\N"
+	}
+
+	d["app"] = p.App
+	d["app_ver"] = p.AppVer
+	d["filename"] = p.Filename
+	d["hostname"] = p.Hostname
+	d["ingest_datetime"] = time.Now().UTC().Format(ISO_8601)
+
+	return d
+}
+
+func (p *RawParser) Parse(line string) (map[string]string, error) {
+	result := p.Defaults()
+	result["log_line"] = strings.TrimSpace(line)
+	return result, nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// logfilePreset is a maintained grok line_regex for a common format. The
+// regex captures the fields under the names the format documents and
+// fieldMappings maps them to pushr's attributes.
+type logfilePreset struct {
+	lineRegex     string
+	timeFormat    string
+	fieldMappings map[string]string
+	urlEncoded    []string // attributes the format url encodes
+}
+
+const (
+	presetCommonLog = `^%{IPORHOST:clientip} %{HTTPDUSER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response} (?:%{NUMBER:bytes}|-)`
+	presetCombined  = presetCommonLog + ` "%{DATA:referrer}" "%{DATA:agent}"`
+)
+
+var commonLogMappings = map[string]string{
+	"remote_address": "clientip",
+	"remote_user":    "auth",
+	"event_datetime": "timestamp",
+	"http_method":    "verb",
+	"http_path":      "request",
+	"log_level":      "response",
+	"response_bytes": "bytes",
+}
+
+var logfilePresets = map[string]logfilePreset{
+	"apache_common": {
+		lineRegex:     presetCommonLog,
+		timeFormat:    "02/Jan/2006:15:04:05 -0700",
+		fieldMappings: commonLogMappings,
+	},
+	"apache_combined": {
+		lineRegex:  presetCombined,
+		timeFormat: "02/Jan/2006:15:04:05 -0700",
+		fieldMappings: withMappings(commonLogMappings, map[string]string{
+			"http_referer": "referrer",
+			"user_agent":   "agent",
+		}),
+	},
+	// nginx combined, with $request_time when it's appended
+	"nginx_combined": {
+		lineRegex:  presetCombined + `(?: %{NUMBER:request_time})?`,
+		timeFormat: "02/Jan/2006:15:04:05 -0700",
+		fieldMappings: withMappings(commonLogMappings, map[string]string{
+			"http_referer": "referrer",
+			"user_agent":   "agent",
+			"response_s":   "request_time",
+		}),
+	},
+	// processing times are -1 when the request never reached a target
+	"aws_alb": {
+		lineRegex:  `^%{NOTSPACE:type} %{TIMESTAMP_ISO8601:time} %{NOTSPACE:elb} %{IP:client_ip}:%{INT:client_port} (?:%{IP:target_ip}:%{INT:target_port}|-) (?:-1|%{NUMBER:request_processing_time}) (?:-1|%{NUMBER:target_processing_time}) (?:-1|%{NUMBER:response_processing_time}) %{NOTSPACE:elb_status_code} %{NOTSPACE:target_status_code} %{NUMBER:received_bytes} %{NUMBER:sent_bytes} "(?:%{WORD:request_verb} %{NOTSPACE:request_url}(?: %{NOTSPACE:request_proto})?|%{DATA:raw_request})" "%{DATA:user_agent}" %{NOTSPACE:ssl_cipher} %{NOTSPACE:ssl_protocol} %{NOTSPACE:target_group_arn} "%{DATA:trace_id}"`,
+		timeFormat: "2006-01-02T15:04:05.999999Z",
+		fieldMappings: map[string]string{
+			"remote_address": "client_ip",
+			"event_datetime": "time",
+			"http_method":    "request_verb",
+			"http_path":      "request_url",
+			"log_level":      "elb_status_code",
+			"response_bytes": "sent_bytes",
+			"response_s":     "target_processing_time",
+			"user_agent":     "user_agent",
+		},
+	},
+	"aws_elb": {
+		lineRegex:  `^%{TIMESTAMP_ISO8601:timestamp} %{NOTSPACE:elb} %{IP:client_ip}:%{INT:client_port} (?:%{IP:backend_ip}:%{INT:backend_port}|-) (?:-1|%{NUMBER:request_processing_time}) (?:-1|%{NUMBER:backend_processing_time}) (?:-1|%{NUMBER:response_processing_time}) %{NOTSPACE:elb_status_code} %{NOTSPACE:backend_status_code} %{NUMBER:received_bytes} %{NUMBER:sent_bytes} "(?:%{WORD:request_verb} %{NOTSPACE:request_url}(?: %{NOTSPACE:request_proto})?|%{DATA:raw_request})"(?: "%{DATA:user_agent}" %{NOTSPACE:ssl_cipher} %{NOTSPACE:ssl_protocol})?`,
+		timeFormat: "2006-01-02T15:04:05.999999Z",
+		fieldMappings: map[string]string{
+			"remote_address": "client_ip",
+			"event_datetime": "timestamp",
+			"http_method":    "request_verb",
+			"http_path":      "request_url",
+			"log_level":      "elb_status_code",
+			"response_bytes": "sent_bytes",
+			"response_s":     "backend_processing_time",
+			"user_agent":     "user_agent",
+		},
+	},
+	// tab separated, date and time are separate fields. the #Version and
+	// #Fields header lines don't match.
+	"cloudfront": {
+		lineRegex:  `^(?P<date_time>\d{4}-\d{2}-\d{2}\t\d{2}:\d{2}:\d{2})\t%{NOTSPACE:x_edge_location}\t%{NUMBER:sc_bytes}\t%{IP:c_ip}\t%{WORD:cs_method}\t%{NOTSPACE:cs_host}\t%{NOTSPACE:cs_uri_stem}\t%{NUMBER:sc_status}\t%{NOTSPACE:cs_referer}\t%{NOTSPACE:cs_user_agent}\t%{NOTSPACE:cs_uri_query}\t%{NOTSPACE:cs_cookie}\t%{NOTSPACE:x_edge_result_type}\t%{NOTSPACE:x_edge_request_id}\t%{NOTSPACE:x_host_header}\t%{NOTSPACE:cs_protocol}\t%{NOTSPACE:cs_bytes}\t%{NUMBER:time_taken}`,
+		timeFormat: "2006-01-02\t15:04:05",
+		fieldMappings: map[string]string{
+			"remote_address": "c_ip",
+			"event_datetime": "date_time",
+			"http_method":    "cs_method",
+			"http_path":      "cs_uri_stem",
+			"http_referer":   "cs_referer",
+			"log_level":      "sc_status",
+			"response_bytes": "sc_bytes",
+			"response_s":     "time_taken",
+			"user_agent":     "cs_user_agent",
+		},
+		urlEncoded: []string{"user_agent", "http_referer"},
+	},
+	// HTTP log format (option httplog), with or without the syslog header
+	"haproxy_http": {
+		lineRegex:  `^(?:%{SYSLOGTIMESTAMP:syslog_timestamp} %{IPORHOST:syslog_server} %{SYSLOGPROG}: )?%{IP:client_ip}:%{INT:client_port} \[(?P<accept_date>\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2}\.\d{3})\] %{NOTSPACE:frontend_name} %{NOTSPACE:backend_name}/%{NOTSPACE:server_name} %{INT:time_request}/%{INT:time_queue}/%{INT:time_backend_connect}/%{INT:time_backend_response}/\+?%{INT:time_duration} %{INT:http_status_code} \+?%{INT:bytes_read} %{NOTSPACE:captured_request_cookie} %{NOTSPACE:captured_response_cookie} %{NOTSPACE:termination_state} %{INT:actconn}/%{INT:feconn}/%{INT:beconn}/%{INT:srvconn}/\+?%{INT:retries} %{INT:srv_queue}/%{INT:backend_queue}(?: \{%{DATA:captured_request_headers}\})?(?: \{%{DATA:captured_response_headers}\})? "(?:%{WORD:http_verb} %{NOTSPACE:http_request}(?: HTTP/%{NUMBER:http_version})?|%{DATA:raw_request})"`,
+		timeFormat: "02/Jan/2006:15:04:05.000",
+		fieldMappings: map[string]string{
+			"remote_address": "client_ip",
+			"event_datetime": "accept_date",
+			"http_method":    "http_verb",
+			"http_path":      "http_request",
+			"log_level":      "http_status_code",
+			"response_bytes": "bytes_read",
+			"response_ms":    "time_duration",
+		},
+	},
+}
+
+func withMappings(base, extra map[string]string) map[string]string {
+	m := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return m
+}
+
+// applyPreset fills in the parse_mode, line_regex and time_format of a
+// preset logfile. Whatever the config sets itself is kept, field_mappings
+// are added to the preset ones.
+func (l *Logfile) applyPreset() error {
+
+	if l.Preset == "" {
+		return nil
+	}
+
+	preset, ok := logfilePresets[l.Preset]
+	if !ok {
+		names := []string{}
+		for name := range logfilePresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("logfile %s has unknown preset %s, must be one of %s", l.Name, l.Preset, strings.Join(names, ", "))
+	}
+
+	if l.ParseMode == "" {
+		l.ParseMode = "grok"
+	}
+	if l.LineRegex == "" {
+		l.LineRegex = preset.lineRegex
+	}
+	if l.TimeFormat == "" {
+		l.TimeFormat = preset.timeFormat
+	}
+	l.FieldMappings = withMappings(preset.fieldMappings, l.FieldMappings)
+
+	return nil
+}
+
+// MappedParser copies the fields a parser extracted to the attributes
+// field_mappings maps them to.
+type MappedParser struct {
+	Parser
+	FieldMappings map[string]string
+	urlEncoded    []string
+}
+
+func NewMappedParser(parser Parser, fieldMappings map[string]string, urlEncoded []string) *MappedParser {
+	return &MappedParser{
+		Parser:        parser,
+		FieldMappings: fieldMappings,
+		urlEncoded:    urlEncoded,
+	}
+}
+
+func (p *MappedParser) Parse(line string) (map[string]string, error) {
+
+	result, err := p.Parser.Parse(line)
+	if err != nil {
+		return result, err
+	}
+
+	for k, v := range p.FieldMappings {
+		if value, ok := result[v]; ok {
+			result[k] = value
+		}
+	}
+
+	for _, k := range p.urlEncoded {
+		if decoded, err := url.PathUnescape(result[k]); err == nil {
+			result[k] = decoded
+		}
+	}
+
+	return result, nil
+}
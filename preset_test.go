@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the preset tests")
+
+type presetTestStream struct{}
+
+func (s presetTestStream) Stream(r *Record) error    { return nil }
+func (s presetTestStream) RecordFormat() []Attribute { return testFormat }
+func (s presetTestStream) Close()                    {}
+
+// TestPresets parses testdata/presets/<preset>.log and compares the
+// attributes set on every line to <preset>.golden. Run with -update after
+// changing a preset to rewrite the golden files.
+func TestPresets(t *testing.T) {
+
+	for name := range logfilePresets {
+
+		logfile := Logfile{Name: name, Filename: name + ".log", Preset: name}
+		if err := logfile.applyPreset(); err != nil {
+			t.Fatal(err.Error())
+		}
+		parser := newParser(logfile, presetTestStream{})
+
+		path := filepath.Join("testdata", "presets", name+".log")
+		f, err := os.Open(path)
+		if err != nil {
+			t.Errorf("missing fixture for preset %s: %s", name, err.Error())
+			continue
+		}
+
+		out := bytes.Buffer{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			record, _ := processLine(logfile, parser, scanner.Text(), testFormat)
+			if record == nil {
+				out.WriteString("null\n")
+				continue
+			}
+			attributes := map[string]string{}
+			for _, attr := range testFormat {
+				if val := record.EventAttributes[attr.Key]; !isUnset(val) {
+					attributes[attr.Key] = val
+				}
+			}
+			line, _ := json.Marshal(attributes)
+			out.Write(line)
+			out.WriteString("\n")
+		}
+		f.Close()
+
+		goldenPath := strings.TrimSuffix(path, ".log") + ".golden"
+		if *updateGolden {
+			if err := ioutil.WriteFile(goldenPath, out.Bytes(), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			continue
+		}
+
+		golden, err := ioutil.ReadFile(goldenPath)
+		if err != nil {
+			t.Errorf("missing golden file for preset %s: %s", name, err.Error())
+			continue
+		}
+		if !bytes.Equal(golden, out.Bytes()) {
+			t.Errorf("preset %s doesn't match %s\nexpected:\n%s\ngot:\n%s", name, goldenPath, golden, out.Bytes())
+		}
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+
+	logfile := Logfile{Name: "lb", Preset: "aws_alb", FieldMappings: map[string]string{"user_tag": "trace_id"}}
+	if err := logfile.applyPreset(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if logfile.ParseMode != "grok" || logfile.TimeFormat != logfilePresets["aws_alb"].timeFormat ||
+		logfile.FieldMappings["user_tag"] != "trace_id" || logfile.FieldMappings["remote_address"] != "client_ip" {
+		t.Fatalf("unexpected logfile %+v", logfile)
+	}
+
+	logfile = Logfile{Name: "lb", Preset: "nope"}
+	if err := logfile.applyPreset(); err == nil {
+		t.Fatal("expected an error for an unknown preset")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -82,64 +83,44 @@ func init() {
 
 func MonitorFile(ctx context.Context, logfile Logfile) error {
 
-	infof, warnf, errorf, fatalf := LogFuncs(logfile)
+	infof, warnf, errorf, _ := LogFuncs(logfile)
 
 	infof("monitoring start")
 
-	stream, ok := gAllStreams[logfile.StreamName]
+	stream, ok := logfileStream(logfile)
 	if !ok {
 		errStr := fmt.Sprintf("stream %s not found to fail file %s", logfile.StreamName, logfile.Filename)
 		return errors.New(errStr)
 	}
 
+	// fast forwarding by timestamp is only used for state files written
+	// before checkpoints were stored
 	fastForward := false
-	if !logfile.LastTimestamp.IsZero() {
+	if logfile.Checkpoint != nil {
+		infof("resuming from offset %d", logfile.Checkpoint.Offset)
+	} else if !logfile.LastTimestamp.IsZero() {
 		warnf("found cached time of last scan at %s", logfile.LastTimestamp)
 		fastForward = true
 	}
 
-	var parser Parser
-	switch logfile.ParseMode {
-	case "regex":
-		parser = NewRegexParser(gApp, appVer(), logfile.Filename, gHostname, logfile.Regex, stream.RecordFormat())
-		break
-	case "json":
-		parser = NewJSONParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldMappings, stream.RecordFormat())
-		break
-	case "csv":
-		parser = NewCSVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldsOrder, stream.RecordFormat(), logfile.ParserOptions)
-		break
-	case "json_raw":
-		parser = NewJSONRawParser(gApp, appVer(), logfile.Filename, gHostname, stream.RecordFormat())
-		break
-	case "date_keyvalue":
-		parser = NewDateKVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldMappings, logfile.KvRegex, stream.RecordFormat(), logfile.ParserOptions)
-		break
-	case "variadic_kv":
-		parser = NewVariadicKVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.KvRegex, stream.RecordFormat(), logfile.ParserOptions)
-		break
-	case "variadic_json":
-		parser = NewVariadicJSONParser(gApp, appVer(), logfile.Filename, gHostname, stream.RecordFormat(), logfile.ParserOptions)
-		break
-	case "plugin":
-		defaults := map[string]string{
-			"app":      gApp,
-			"app_ver":  appVer(),
-			"filename": logfile.Filename,
-			"hostname": gHostname,
-		}
-		parser = LoadParserPlugin(logfile.ParserPluginPath)
-		parser.Init(defaults, logfile.FieldMappings, logfile.FieldsOrder, stream.RecordFormat())
-	default:
-		fatalf("%s parse_mode not supported", logfile.ParseMode)
-	}
+	parser := newParser(logfile, stream)
 
 	// delim := regexp.MustCompile(`\d{4}/\d{2}/\d{2}\s\d{2}\:\d{2}\:\d{2}\.\d{3}\s`)
+	isStream := tail.IsStream(logfile.Filename)
+
+	var backlog []string
+	if !isStream {
+		backlog = tail.Backlog(logfile.Filename, logfile.RotatedPattern, logfile.Checkpoint)
+	}
+	if len(backlog) > 0 {
+		infof("catching up on %d rotated files", len(backlog))
+	}
+
 	var t *tail.Tail
 	if logfile.FrontSplitRegexStr != "" {
-		t = tail.NewTailWithCtx(ctx, logfile.Filename, gFollow, logfile.RetryFileOpen, logfile.FrontSplitRegex, true, logfile.SkipToEnd)
+		t = tail.NewTailWithCtx(ctx, logfile.Filename, gFollow, logfile.RetryFileOpen, logfile.FrontSplitRegex, true, logfile.SkipToEnd, logfile.Checkpoint, backlog)
 	} else {
-		t = tail.NewTailWithCtx(ctx, logfile.Filename, gFollow, logfile.RetryFileOpen, nil, false, logfile.SkipToEnd)
+		t = tail.NewTailWithCtx(ctx, logfile.Filename, gFollow, logfile.RetryFileOpen, nil, false, logfile.SkipToEnd, logfile.Checkpoint, backlog)
 	}
 
 	stringBuffer := bytes.NewBufferString("")
@@ -147,9 +128,74 @@ func MonitorFile(ctx context.Context, logfile Logfile) error {
 	var streamed_lines_ctr uint64 = 0
 	var lines_ctr uint64 = 0
 	bufferMultiLines := logfile.BufferMultiLines
-	skipHeader := false
-	if logfile.SkipHeaderLine {
-		skipHeader = true
+
+	// the checkpoint of a line is only saved once every record read up to
+	// it has been acked by the stream. bufferAck holds back the first line
+	// in stringBuffer until the buffer is flushed.
+	tracker := newCheckpointTracker(logfile.Filename)
+	tracker.stateless = isStream
+	var bufferAck func()
+
+	// container runtimes split long messages over several lines. like
+	// bufferAck, partialAck holds back the first part until the message
+	// has been read, heldAck until the record of the message is acked.
+	partials, _ := parser.(partialParser)
+	var partialAck, heldAck func()
+
+	// parts of messages that don't get their last part are sent as they
+	// are after a while, and when the file ends
+	var partialTimeout <-chan time.Time
+	streamPartials := func() {
+		partialTimeout = nil
+		if partialAck == nil {
+			return
+		}
+		lines := partials.Flush()
+		if len(lines) == 0 {
+			partialAck()
+			partialAck = nil
+			return
+		}
+		ack := shareAck(partialAck, len(lines))
+		partialAck = nil
+		for _, text := range lines {
+			record, eventDatetime := processLine(logfile, parser, text, stream.RecordFormat())
+			if record == nil || (eventDatetime != nil && eventDatetime.Before(gTimeThreshold)) || !keepLine(logfile, text, record) {
+				ack()
+				continue
+			}
+			record.SetAck(ack)
+			if err := stream.Stream(record); err != nil {
+				errorf("error streaming:\n%s", err.Error())
+			}
+			streamed_lines_ctr += 1
+		}
+	}
+
+	// lines that aren't streamed still release the parts they completed
+	skipLine := func(cp tail.Checkpoint, eventDatetime *time.Time) {
+		tracker.track(cp, eventDatetime, 0)
+		if heldAck != nil {
+			heldAck()
+			heldAck = nil
+		}
+	}
+
+	// with multiline settings the record of a line is held until the lines
+	// that go with it have been read
+	multiline := newMultilineBuffer(logfile)
+	var multilineTimeout <-chan time.Time
+	streamMessage := func() {
+		multilineTimeout = nil
+		record, ack := multiline.take()
+		if record == nil {
+			return
+		}
+		record.SetAck(ack)
+		if err := stream.Stream(record); err != nil {
+			errorf("error streaming:\n%s", err.Error())
+		}
+		streamed_lines_ctr += 1
 	}
 
 LOOP:
@@ -158,37 +204,98 @@ LOOP:
 		case <-flushTimer.C:
 			if stringBuffer.Len() > 0 {
 				infof("flushing...")
-				flush(stringBuffer.String(), parser, stream)
+				flush(logfile, stringBuffer.String(), parser, stream, bufferAck)
 				stringBuffer.Reset()
 			}
 			break
+		case <-multilineTimeout:
+			streamMessage()
+		case <-partialTimeout:
+			streamPartials()
 		case line, ok := <-t.LineChan:
 
 			if !ok {
+				// end of a pipe or shutdown, send what's still buffered
+				streamPartials()
+				if multiline != nil {
+					streamMessage()
+				}
+				if stringBuffer.Len() > 0 {
+					flush(logfile, stringBuffer.String(), parser, stream, bufferAck)
+					stringBuffer.Reset()
+				}
 				break LOOP
 			}
 
-			if skipHeader {
-				skipHeader = false
+			if line.Rotation != nil {
+				infof("file %s after %d bytes. reading from the start", line.Rotation.Reason, line.Rotation.Offset)
+				streamPartials()
+				if multiline != nil {
+					streamMessage()
+				}
+				if stringBuffer.Len() > 0 {
+					flush(logfile, stringBuffer.String(), parser, stream, bufferAck)
+					stringBuffer.Reset()
+				}
+				tracker.track(line.Checkpoint, nil, 0)
 				continue
 			}
 
+			if logfile.SkipHeaderLine && line.Offset == 0 {
+				tracker.track(line.Checkpoint, nil, 0)
+				continue
+			}
+
+			if partials != nil {
+				if partials.Partial(line.Text) {
+					if partialAck == nil {
+						partialAck = tracker.track(line.Checkpoint, nil, 1)
+					} else {
+						tracker.track(line.Checkpoint, nil, 0)
+					}
+					partialTimeout = time.After(CONTAINER_PARTIAL_TIMEOUT)
+					continue
+				}
+			}
+
+			if multiline != nil {
+				if multiline.continues(line.Text) {
+					multiline.append(line.Text)
+					tracker.track(line.Checkpoint, nil, 0)
+					if multiline.complete() {
+						streamMessage()
+					}
+					continue
+				}
+				// a new message, the last one has all its lines
+				streamMessage()
+				multiline.start(line.Text)
+			}
+
 			lines_ctr += 1
 
-			record, eventDatetime := processLine(logfile, parser, line, stream.RecordFormat())
+			record, eventDatetime := processLine(logfile, parser, line.Text, stream.RecordFormat())
+			if partialAck != nil && !partials.Pending() {
+				// the parts were put together by this line
+				heldAck, partialAck = partialAck, nil
+				partialTimeout = nil
+			}
 			if fastForward && eventDatetime == nil {
 				// when fastforwarding skip lines without event_datetime
 				// log.Printf("skip 1")
+				skipLine(line.Checkpoint, nil)
 				continue
 			}
 
 			if fastForward && (eventDatetime.Before(logfile.LastTimestamp) || eventDatetime.Equal(logfile.LastTimestamp)) {
 				// log.Printf("skip 2")
+				skipLine(line.Checkpoint, nil)
 				continue
 			}
 
 			if eventDatetime != nil && eventDatetime.Before(gTimeThreshold) {
 				// log.Printf("skip 3")
+				skipLine(line.Checkpoint, eventDatetime)
 				continue
 			}
 
@@ -197,31 +304,62 @@ LOOP:
 				// and it will stream the buffer once a line has been able to be parsed
 				// or if the MAX_BUFFERED_LINE is reached.
 				if record == nil && stringBuffer.Len() < MAX_BUFFERED_LINE {
-					stringBuffer.WriteString(line)
+					if stringBuffer.Len() == 0 {
+						bufferAck = tracker.track(line.Checkpoint, nil, 1)
+						if heldAck != nil {
+							bufferAck = chainAcks(bufferAck, heldAck)
+							heldAck = nil
+						}
+					} else {
+						skipLine(line.Checkpoint, nil)
+					}
+					stringBuffer.WriteString(line.Text)
 					stringBuffer.WriteString("\\n")
 					// log.Printf("skip 4")
 					continue
 				}
 
 			} else if record == nil && eventDatetime == nil { // this means that processLine could not parse the line
-				errorf("unable to parse line %d: %s", lines_ctr, line)
+				errorf("unable to parse line %d: %s", lines_ctr, line.Text)
 				// log.Printf("skip 5")
+				skipLine(line.Checkpoint, nil)
 				continue
 			}
 
 			fastForward = false
 
+			if !keepLine(logfile, line.Text, record) {
+				skipLine(line.Checkpoint, eventDatetime)
+				continue
+			}
+
 			if bufferMultiLines {
 				if (record != nil && stringBuffer.Len() > 0) || stringBuffer.Len() >= MAX_BUFFERED_LINE {
-					flush(stringBuffer.String(), parser, stream)
+					flush(logfile, stringBuffer.String(), parser, stream, bufferAck)
 					stringBuffer.Reset()
 					if record == nil {
 						// log.Printf("skip 6")
+						skipLine(line.Checkpoint, nil)
 						continue
 					}
 				}
 			}
 
+			ack := tracker.track(line.Checkpoint, eventDatetime, 1)
+			if heldAck != nil {
+				ack = chainAcks(ack, heldAck)
+				heldAck = nil
+			}
+			if multiline != nil {
+				multiline.keep(record, ack)
+				if multiline.complete() {
+					streamMessage()
+				} else {
+					multilineTimeout = time.After(multiline.timeout)
+				}
+				continue
+			}
+			record.SetAck(ack)
 			err := stream.Stream(record)
 			if err != nil {
 				errorf("error streaming:\n%s", err.Error())
@@ -235,7 +373,103 @@ LOOP:
 	return nil
 }
 
-func MonitorDir(ctx context.Context, logfile Logfile, files []string) error {
+// chainAcks acks both when a record is acked.
+func chainAcks(first, second func()) func() {
+	return func() {
+		first()
+		second()
+	}
+}
+
+// shareAck splits an ack between n records, it's called once all of them
+// are acked.
+func shareAck(ack func(), n int) func() {
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			ack()
+		}
+	}
+}
+
+// newParser returns the parser for the parse_mode of a logfile.
+func newParser(logfile Logfile, stream Streamer) Parser {
+
+	_, _, _, fatalf := LogFuncs(logfile)
+
+	if len(logfile.Parsers) > 0 {
+		return newChainParser(logfile, stream)
+	}
+
+	var parser Parser
+	switch logfile.ParseMode {
+	case "regex":
+		re := logfile.Regex
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(logfile.LineRegex); err != nil {
+				fatalf("unable to compile line_regex: %s", err.Error())
+			}
+		}
+		parser = NewRegexParser(gApp, appVer(), logfile.Filename, gHostname, re, stream.RecordFormat())
+		break
+	case "raw":
+		parser = NewRawParser(gApp, appVer(), logfile.Filename, gHostname, stream.RecordFormat())
+		break
+	case "grok":
+		re, err := compileGrok(logfile)
+		if err != nil {
+			fatalf("unable to compile grok line_regex: %s", err.Error())
+		}
+		parser = NewRegexParser(gApp, appVer(), logfile.Filename, gHostname, re, stream.RecordFormat())
+		if len(logfile.FieldMappings) > 0 {
+			parser = NewMappedParser(parser, logfile.FieldMappings, logfilePresets[logfile.Preset].urlEncoded)
+		}
+		break
+	case "json":
+		parser = NewJSONParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldMappings, stream.RecordFormat())
+		break
+	case "csv":
+		parser = NewCSVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldsOrder, stream.RecordFormat(), logfile.ParserOptions)
+		break
+	case "json_raw":
+		parser = NewJSONRawParser(gApp, appVer(), logfile.Filename, gHostname, stream.RecordFormat())
+		break
+	case "date_keyvalue":
+		parser = NewDateKVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldMappings, logfile.KvRegex, stream.RecordFormat(), logfile.ParserOptions)
+		break
+	case "logfmt":
+		parser = NewLogfmtParser(gApp, appVer(), logfile.Filename, gHostname, logfile.FieldMappings, stream.RecordFormat())
+		break
+	case "docker":
+		parser = NewContainerParser(gApp, appVer(), logfile.Filename, gHostname, false, stream.RecordFormat())
+		break
+	case "cri":
+		parser = NewContainerParser(gApp, appVer(), logfile.Filename, gHostname, true, stream.RecordFormat())
+		break
+	case "variadic_kv":
+		parser = NewVariadicKVParser(gApp, appVer(), logfile.Filename, gHostname, logfile.KvRegex, stream.RecordFormat(), logfile.ParserOptions)
+		break
+	case "variadic_json":
+		parser = NewVariadicJSONParser(gApp, appVer(), logfile.Filename, gHostname, stream.RecordFormat(), logfile.ParserOptions)
+		break
+	case "plugin":
+		defaults := map[string]string{
+			"app":      gApp,
+			"app_ver":  appVer(),
+			"filename": logfile.Filename,
+			"hostname": gHostname,
+		}
+		parser = LoadParserPlugin(logfile.ParserPluginPath)
+		parser.Init(defaults, logfile.FieldMappings, logfile.FieldsOrder, stream.RecordFormat())
+	default:
+		fatalf("%s parse_mode not supported", logfile.ParseMode)
+	}
+
+	return parser
+}
+
+func MonitorDir(ctx context.Context, logfile Logfile, files []string, lastState map[string]Logfile) error {
 
 	infof, _, errorf, fatalf := LogFuncs(logfile)
 	infof("monitoring dir start")
@@ -274,6 +508,10 @@ LOOP:
 			switch {
 			case newExt == configExt:
 				logfile.Filename = newFile
+				logfile.Checkpoint = nil
+				if savedState, ok := lastState[newFile]; ok {
+					logfile.Checkpoint = savedState.Checkpoint
+				}
 				ctx, cancel := context.WithCancel(monitorDirCtx)
 				ctxs[logfile.Filename] = cancel
 				wg.Add(1)
@@ -304,16 +542,35 @@ LOOP:
 	return nil
 }
 
-func flush(data string, parser Parser, stream Streamer) error {
+func flush(logfile Logfile, data string, parser Parser, stream Streamer, ack func()) error {
 
 	m := parser.Defaults()
 	r := NewRecord(data, parser.GetTable(), m)
+	r.logfile = logfile.Name
+	r.SetAck(ack)
 	m["log_line"] = data
 	err := stream.Stream(r)
 	return err
 
 }
 
+// rawRecord is a record for a line the parser couldn't make sense of, with
+// the parser defaults and the line as log_line.
+func rawRecord(logfile Logfile, parser Parser, line string, recordFormat []Attribute) *Record {
+	attributes := parser.Defaults()
+	attributes["log_line"] = line
+	r := NewRecord(line, recordFormat, attributes)
+	r.logfile = logfile.Name
+	return r
+}
+
+// setUnset sets an attribute the parser left empty.
+func setUnset(attributes map[string]string, key, val string) {
+	if current, ok := attributes[key]; (!ok || isUnset(current)) && val != "" {
+		attributes[key] = val
+	}
+}
+
 func processLine(logfile Logfile, parser Parser, line string, recordFormat []Attribute) (*Record, *time.Time) {
 
 	infof, _, _, _ := LogFuncs(logfile)
@@ -346,6 +603,10 @@ func processLine(logfile Logfile, parser Parser, line string, recordFormat []Att
 		eventAttributes["os"], eventAttributes["os_ver"] = parseOS(userAgent)
 	}
 
+	// transforms see response_ms, browser and os, and can still set
+	// event_datetime
+	transformAttributes(logfile.Transforms, eventAttributes)
+
 	stringTimestamp := eventAttributes["event_datetime"]
 	eventDatetime, err = parseTimestamp(stringTimestamp, logfile.TimeFormat)
 	if err != nil {
@@ -354,16 +615,12 @@ func processLine(logfile Logfile, parser Parser, line string, recordFormat []Att
 		eventAttributes["event_datetime"] = eventDatetime.Format(ISO_8601)
 	}
 
-	if eventDatetime != nil {
-		logfile.LastTimestamp = *eventDatetime
-		gUpdateCacheChan <- UpdateMessage{logfile.Filename, *eventDatetime}
-	}
-
 	if _, ok := eventAttributes["event_datetime"]; !ok {
 		eventAttributes["event_datetime"] = eventAttributes["ingest_datetime"]
 	}
 
 	r := NewRecord(line, recordFormat, eventAttributes)
+	r.logfile = logfile.Name
 
 	return r, eventDatetime
 }
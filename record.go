@@ -12,12 +12,19 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// Streamer delivers records. Once a stream is done with a record, either
+// because it was delivered or because the destination permanently rejected
+// it, the stream calls Record.Ack. Records a stream gives up on after
+// running out of retries go through dropRecords, which acks them too.
 type Streamer interface {
 	Stream(*Record) error
 	RecordFormat() []Attribute
@@ -28,6 +35,15 @@ type Record struct {
 	EventAttributes map[string]string
 	recordFormat    []Attribute
 	rawLine         string
+	logfile         string // name of the Logfile the line came from
+	ack             func()
+}
+
+// encodedRecord is a record converted to what a stream sends, along with
+// the ack of the record it came from.
+type encodedRecord struct {
+	data []byte
+	ack  func()
 }
 
 func NewRecord(line string, recordFormat []Attribute, attributes map[string]string) *Record {
@@ -39,6 +55,28 @@ func NewRecord(line string, recordFormat []Attribute, attributes map[string]stri
 	return &r
 }
 
+func (r *Record) SetAck(ack func()) {
+	r.ack = ack
+}
+
+func (r *Record) Ack() {
+	if r.ack != nil {
+		r.ack()
+	}
+}
+
+// dropRecords is what every stream does with records it gives up on: they
+// are logged as lost and acked, so the checkpoints of their files still
+// move on instead of waiting for them forever.
+func dropRecords(acks []func(), format string, args ...interface{}) {
+	log.Errorf("%d records lost, %s", len(acks), fmt.Sprintf(format, args...))
+	for _, ack := range acks {
+		if ack != nil {
+			ack()
+		}
+	}
+}
+
 func (r *Record) Hash() []byte {
 	h := md5.New()
 	h.Write([]byte(r.rawLine))
@@ -130,6 +168,62 @@ func (r *Record) RecordToCSV() []byte {
 	return csvData.Bytes()
 }
 
+// RecordToMap converts the record to typed values following the record
+// format. Nulls and values that fail to convert are nil.
+func (r *Record) RecordToMap() map[string]interface{} {
+
+	doc := make(map[string]interface{}, len(r.recordFormat))
+	for _, attr := range r.recordFormat {
+
+		val := r.EventAttributes[attr.Key]
+		if attr.Key == "_uuid" {
+			doc[attr.Key], _ = GenerateUUID()
+			continue
+		}
+
+		if isUnset(val) {
+			doc[attr.Key] = nil
+			continue
+		}
+
+		var convVal interface{}
+		var err error
+		switch attr.Type {
+		case "string":
+			convVal = strings.Replace(ConvertToUTF8(val, attr.Length), "\x00", "", -1)
+		case "timestamp":
+			convVal, err = toDestinationTimestamp(attr.SourceTimestampFormat, attr.DestinationTimestampFormat, ConvertToUTF8(val, attr.Length))
+		case "integer":
+			convVal, err = strconv.Atoi(val)
+		case "float32":
+			convVal, err = strconv.ParseFloat(val, 32)
+		case "float64", "double":
+			convVal, err = strconv.ParseFloat(val, 64)
+		case "bool":
+			convVal, err = strconv.ParseBool(val)
+		default:
+			log.Warnf("unknown attritbute type: %s", attr.Type)
+		}
+
+		if err != nil {
+			log.Warnf("conversion err '%s', to %s: %s", val, attr.Type, err.Error())
+			convVal = nil
+		}
+		doc[attr.Key] = convVal
+	}
+
+	return doc
+}
+
+func (r *Record) RecordToJSON() []byte {
+	data, err := json.Marshal(r.RecordToMap())
+	if err != nil {
+		log.Warnf("unable to encode record: %s", err.Error())
+		return nil
+	}
+	return data
+}
+
 func toDestinationTimestamp(sourceFormat, destinationFormat, input string) (string, error) {
 	if sourceFormat == "" {
 		return input, nil
@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	REDACT_MASK             = "[REDACTED]"
+	REDACT_IPV4_PREFIX      = 24
+	REDACT_IPV6_PREFIX      = 48
+	REDACT_MIN_SCRUB_LENGTH = 4 // shorter values would be replaced all over log_line
+)
+
+// RedactConfig is what to take out of the records of a logfile or stream
+// before they're sent. Hashed and truncated attributes are also replaced
+// wherever their value shows up in log_line.
+type RedactConfig struct {
+	Detectors        []string `yaml:"detectors" json:"detectors,omitempty"`     // email, ipv4, ipv6, credit_card, bearer_token
+	Patterns         []string `yaml:"patterns" json:"patterns,omitempty"`       // regexes to mask
+	Mask             string   `yaml:"mask" json:"mask,omitempty"`               // [REDACTED] by default
+	MaskFields       []string `yaml:"mask_fields" json:"mask_fields,omitempty"` // attributes to mask in, log_line by default
+	HashFields       []string `yaml:"hash_fields" json:"hash_fields,omitempty"` // replaced by their HMAC-SHA256
+	HashKey          string   `yaml:"hash_key" json:"-"`
+	HashKeyEnv       string   `yaml:"hash_key_env" json:"hash_key_env,omitempty"` // environment variable with the hash key
+	TruncateIPFields []string `yaml:"truncate_ip_fields" json:"truncate_ip_fields,omitempty"`
+	IPv4Prefix       int      `yaml:"ipv4_prefix" json:"ipv4_prefix,omitempty"` // 24 by default
+	IPv6Prefix       int      `yaml:"ipv6_prefix" json:"ipv6_prefix,omitempty"` // 48 by default
+}
+
+// redactDetector finds a kind of value. replace returns what goes instead
+// of a match, the match itself when it isn't one, nil masks all of it.
+type redactDetector struct {
+	re      *regexp.Regexp
+	replace func(match, mask string) string
+}
+
+var redactDetectors = map[string]redactDetector{
+	"email": {
+		re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	"ipv4": {
+		re:      regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`),
+		replace: maskIP,
+	},
+	"ipv6": {
+		re:      regexp.MustCompile(`(?i)(?:[0-9a-f]{1,4}|:)?:(?:[0-9a-f]{0,4}:){1,6}[0-9a-f]{0,4}`),
+		replace: maskIP,
+	},
+	"credit_card": {
+		re: regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		replace: func(match, mask string) string {
+			if luhn(match) {
+				return mask
+			}
+			return match
+		},
+	},
+	// the Bearer stays so it's clear what was there
+	"bearer_token": {
+		re: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`),
+		replace: func(match, mask string) string {
+			return match[:strings.IndexAny(match, " \t")+1] + mask
+		},
+	},
+}
+
+// maskIP masks an address, the ipv6 pattern can take in the : after one.
+func maskIP(match, mask string) string {
+	if net.ParseIP(match) != nil {
+		return mask
+	}
+	if trimmed := strings.TrimRight(match, ":"); net.ParseIP(trimmed) != nil {
+		return mask + match[len(trimmed):]
+	}
+	return match
+}
+
+// luhn checks the digits of a card number.
+func luhn(number string) bool {
+
+	sum := 0
+	digits := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits += 1
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
+
+// Redactor applies a RedactConfig to records.
+type Redactor struct {
+	detectors      []redactDetector
+	mask           string
+	maskFields     []string
+	hashFields     []string
+	hashKey        []byte
+	truncateFields []string
+	ipv4Mask       net.IPMask
+	ipv6Mask       net.IPMask
+}
+
+func NewRedactor(config RedactConfig) (*Redactor, error) {
+
+	r := &Redactor{
+		mask:           config.Mask,
+		maskFields:     config.MaskFields,
+		hashFields:     config.HashFields,
+		truncateFields: config.TruncateIPFields,
+	}
+
+	if r.mask == "" {
+		r.mask = REDACT_MASK
+	}
+	if len(r.maskFields) == 0 {
+		r.maskFields = []string{"log_line"}
+	}
+
+	for _, name := range config.Detectors {
+		detector, ok := redactDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redact detector %s", name)
+		}
+		r.detectors = append(r.detectors, detector)
+	}
+	for _, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %s", pattern, err.Error())
+		}
+		r.detectors = append(r.detectors, redactDetector{re: re})
+	}
+
+	if len(r.hashFields) > 0 {
+		key := config.HashKey
+		if config.HashKeyEnv != "" {
+			key = os.Getenv(config.HashKeyEnv)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("hash_fields needs a hash_key or hash_key_env")
+		}
+		r.hashKey = []byte(key)
+	}
+
+	ipv4Prefix, ipv6Prefix := config.IPv4Prefix, config.IPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = REDACT_IPV4_PREFIX
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = REDACT_IPV6_PREFIX
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ip prefix /%d or /%d", ipv4Prefix, ipv6Prefix)
+	}
+	r.ipv4Mask = net.CIDRMask(ipv4Prefix, 32)
+	r.ipv6Mask = net.CIDRMask(ipv6Prefix, 128)
+
+	return r, nil
+}
+
+// redactConfigFromOptions reads the redaction options of a stream, nil
+// when there are none.
+func redactConfigFromOptions(opts map[string]string) (*RedactConfig, error) {
+
+	config := RedactConfig{}
+	found := false
+
+	list := func(val string) []string {
+		return omitEmpty(strings.Split(strings.Replace(val, " ", "", -1), ","))
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "redact_detectors":
+			config.Detectors = list(val)
+		case "redact_pattern":
+			config.Patterns = []string{val}
+		case "redact_mask":
+			config.Mask = val
+		case "redact_fields":
+			config.MaskFields = list(val)
+		case "hash_fields":
+			config.HashFields = list(val)
+		case "hash_key":
+			config.HashKey = val
+		case "hash_key_env":
+			config.HashKeyEnv = val
+		case "truncate_ip_fields":
+			config.TruncateIPFields = list(val)
+		case "ipv4_prefix", "ipv6_prefix":
+			prefix, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s", key, val)
+			}
+			if key == "ipv4_prefix" {
+				config.IPv4Prefix = prefix
+			} else {
+				config.IPv6Prefix = prefix
+			}
+		default:
+			continue
+		}
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return &config, nil
+}
+
+// applyRedact builds the redactor of a logfile.
+func (l *Logfile) applyRedact() error {
+
+	if l.Redact == nil {
+		return nil
+	}
+
+	redactor, err := NewRedactor(*l.Redact)
+	if err != nil {
+		return fmt.Errorf("logfile %s: %s", l.Name, err.Error())
+	}
+	l.redactor = redactor
+	return nil
+}
+
+// logfileStream returns the stream of a logfile, behind its redactor when
+// it has one.
+func logfileStream(logfile Logfile) (Streamer, bool) {
+	stream, ok := gAllStreams[logfile.StreamName]
+	if ok && logfile.redactor != nil {
+		stream = NewRedactStream(stream, logfile.redactor)
+	}
+	return stream, ok
+}
+
+// Redact truncates and hashes the attributes, replaces their old values
+// in log_line and masks what the detectors find.
+func (r *Redactor) Redact(record *Record) {
+
+	attributes := record.EventAttributes
+	original := make(map[string]string)
+
+	for _, field := range r.truncateFields {
+		val, ok := attributes[field]
+		if !ok || isUnset(val) {
+			continue
+		}
+		if truncated, ok := r.truncateIP(val); ok {
+			original[field] = val
+			attributes[field] = truncated
+		}
+	}
+
+	for _, field := range r.hashFields {
+		val, ok := attributes[field]
+		if !ok || isUnset(val) {
+			continue
+		}
+		if _, ok := original[field]; !ok {
+			original[field] = val
+		}
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(val))
+		attributes[field] = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	// longest first, an ip can be the start of another one
+	olds := []string{}
+	replacements := make(map[string]string)
+	for field, val := range original {
+		if len(val) >= REDACT_MIN_SCRUB_LENGTH {
+			olds = append(olds, regexp.QuoteMeta(val))
+			replacements[val] = attributes[field]
+		}
+	}
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	var oldValues *regexp.Regexp
+	if len(olds) > 0 {
+		oldValues = regexp.MustCompile(strings.Join(olds, "|"))
+	}
+
+	scrub := func(val string) string {
+		if oldValues != nil {
+			val = replaceTokens(val, oldValues, replacements)
+		}
+		return r.maskAll(val)
+	}
+
+	for _, field := range r.maskFields {
+		if val, ok := attributes[field]; ok && val != "\\N" {
+			attributes[field] = scrub(val)
+		}
+	}
+	// what the syslog, loki and splunk streams send
+	record.rawLine = scrub(record.rawLine)
+}
+
+// replaceTokens replaces the matches of re that are whole tokens, 10.0.0.1
+// stays in 10.0.0.15 and 1234 in 123456.
+func replaceTokens(val string, re *regexp.Regexp, replacements map[string]string) string {
+
+	out := strings.Builder{}
+	last := 0
+	for start := 0; start < len(val); {
+		loc := re.FindStringIndex(val[start:])
+		if loc == nil {
+			break
+		}
+		i, j := start+loc[0], start+loc[1]
+		if !wholeToken(val, i, j) {
+			_, size := utf8.DecodeRuneInString(val[i:])
+			start = i + size
+			continue
+		}
+		out.WriteString(val[last:i])
+		out.WriteString(replacements[val[i:j]])
+		last, start = j, j
+	}
+	out.WriteString(val[last:])
+
+	return out.String()
+}
+
+// wholeToken is true when val[i:j] isn't next to a letter, digit or _. A
+// . only ends a token when there's no more of it on the other side.
+func wholeToken(val string, i, j int) bool {
+	before, _ := utf8.DecodeLastRuneInString(strings.TrimSuffix(val[:i], "."))
+	after, _ := utf8.DecodeRuneInString(strings.TrimPrefix(val[j:], "."))
+	return !isTokenRune(before) && !isTokenRune(after)
+}
+
+func isTokenRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (r *Redactor) maskAll(val string) string {
+	for _, detector := range r.detectors {
+		val = detector.re.ReplaceAllStringFunc(val, func(match string) string {
+			if detector.replace != nil {
+				return detector.replace(match, r.mask)
+			}
+			return r.mask
+		})
+	}
+	return val
+}
+
+// truncateIP zeroes the host part of an address.
+func (r *Redactor) truncateIP(val string) (string, bool) {
+
+	ip := net.ParseIP(val)
+	if ip == nil {
+		return val, false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(r.ipv4Mask).String(), true
+	}
+	return ip.Mask(r.ipv6Mask).String(), true
+}
+
+// RedactStream redacts records before handing them to its stream.
+type RedactStream struct {
+	Streamer
+	redactor *Redactor
+}
+
+func NewRedactStream(stream Streamer, redactor *Redactor) *RedactStream {
+	return &RedactStream{
+		Streamer: stream,
+		redactor: redactor,
+	}
+}
+
+func (s *RedactStream) Stream(r *Record) error {
+	s.redactor.Redact(r)
+	return s.Streamer.Stream(r)
+}
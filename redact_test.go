@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+
+	os.Setenv("PUSHR_TEST_HASH_KEY", "secret")
+	defer os.Unsetenv("PUSHR_TEST_HASH_KEY")
+
+	redactor, err := NewRedactor(RedactConfig{
+		Detectors:        []string{"email", "ipv6", "credit_card", "bearer_token"},
+		Patterns:         []string{`session=\w+`},
+		HashFields:       []string{"user_tag"},
+		HashKeyEnv:       "PUSHR_TEST_HASH_KEY",
+		TruncateIPFields: []string{"remote_address"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	line := "user bob42 from 10.1.2.3 paid with 4111 1111 1111 1111 (order 1234567890123) " +
+		"mail bob@example.com via 2001:db8::1: Authorization: Bearer abc.def-ghi session=xyz at 12:30:45"
+	record := NewRecord(line, nil, map[string]string{
+		"user_tag":       "bob42",
+		"remote_address": "10.1.2.3",
+		"log_line":       line,
+	})
+	redactor.Redact(record)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("bob42"))
+	hashed := hex.EncodeToString(mac.Sum(nil))
+
+	if record.EventAttributes["user_tag"] != hashed {
+		t.Errorf("expected user_tag %s, got %s", hashed, record.EventAttributes["user_tag"])
+	}
+	if record.EventAttributes["remote_address"] != "10.1.2.0" {
+		t.Errorf("expected remote_address 10.1.2.0, got %s", record.EventAttributes["remote_address"])
+	}
+
+	expected := "user " + hashed + " from 10.1.2.0 paid with [REDACTED] (order 1234567890123) " +
+		"mail [REDACTED] via [REDACTED]: Authorization: Bearer [REDACTED] [REDACTED] at 12:30:45"
+	if record.EventAttributes["log_line"] != expected {
+		t.Errorf("expected log_line\n%s\ngot\n%s", expected, record.EventAttributes["log_line"])
+	}
+	if record.rawLine != expected {
+		t.Errorf("expected the raw line to be redacted too, got %s", record.rawLine)
+	}
+
+	if truncated, _ := redactor.truncateIP("2001:db8:abcd:12::1"); truncated != "2001:db8:abcd::" {
+		t.Errorf("expected the ipv6 address cut to /48, got %s", truncated)
+	}
+
+	if _, err := NewRedactor(RedactConfig{HashFields: []string{"user_tag"}}); err == nil {
+		t.Errorf("expected an error for hash_fields without a key")
+	}
+	if _, err := NewRedactor(RedactConfig{Detectors: []string{"ssn"}}); err == nil {
+		t.Errorf("expected an error for an unknown detector")
+	}
+}
+
+func TestRedactWholeTokens(t *testing.T) {
+
+	redactor, err := NewRedactor(RedactConfig{
+		HashFields:       []string{"user_tag"},
+		HashKey:          "secret",
+		TruncateIPFields: []string{"remote_address"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	line := "for 10.0.0.15 and 10.0.0.1, order 123456 by 1234."
+	record := NewRecord(line, nil, map[string]string{
+		"user_tag":       "1234",
+		"remote_address": "10.0.0.1",
+		"log_line":       line,
+	})
+	redactor.Redact(record)
+
+	expected := "for 10.0.0.15 and 10.0.0.0, order 123456 by " + record.EventAttributes["user_tag"] + "."
+	if record.EventAttributes["log_line"] != expected {
+		t.Errorf("expected log_line\n%s\ngot\n%s", expected, record.EventAttributes["log_line"])
+	}
+}
+
+func TestRedactStreamOptions(t *testing.T) {
+
+	config, err := redactConfigFromOptions(ParseOptions([]string{"batch_size: 10"}))
+	if err != nil || config != nil {
+		t.Fatalf("expected no redaction without its options, got %+v %v", config, err)
+	}
+
+	config, err = redactConfigFromOptions(ParseOptions([]string{
+		"redact_detectors: email, ipv4",
+		"truncate_ip_fields: remote_address",
+		"ipv4_prefix: 16",
+	}))
+	if err != nil || config == nil {
+		t.Fatalf("expected a redact config, got %v", err)
+	}
+	redactor, err := NewRedactor(*config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stream := &testStream{format: testFormat}
+	NewRedactStream(stream, redactor).Stream(NewRecord("", nil, map[string]string{
+		"remote_address": "10.1.2.3",
+		"log_line":       "from 192.168.1.1 for ann@example.com",
+	}))
+	attributes := stream.records[0].EventAttributes
+	if attributes["remote_address"] != "10.1.0.0" || strings.Contains(attributes["log_line"], "@") || strings.Contains(attributes["log_line"], "192.") {
+		t.Errorf("unexpected redacted record %v", attributes)
+	}
+}
@@ -0,0 +1,523 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	SPOOL_MAX_SIZE_DEFAULT     int64 = 1 << 30  // 1GB
+	SPOOL_SEGMENT_SIZE_DEFAULT int64 = 16 << 20 // 16MB
+	SPOOL_OVERFLOW_BLOCK             = "block"
+	SPOOL_OVERFLOW_DROP_OLDEST       = "drop_oldest"
+	spoolSegmentExt                  = ".seg"
+)
+
+var (
+	ErrSpoolClosed   = errors.New("spool closed")
+	ErrSpoolTooLarge = errors.New("record larger than spool_max_size")
+)
+
+// Spool is an on disk write-ahead buffer that sits between Stream() and
+// the upload goroutines of a stream. Records are appended to segment files
+// as length prefixed frames and acked to the tailer once they are synced
+// to disk. With spool_sync false they are acked as soon as they are
+// written, faster but a crash of the machine loses the records the OS
+// hadn't flushed yet, and their lines are never read again. Pump feeds them back to the stream and a segment is deleted once
+// every record in it has been delivered. Segments left over from a
+// previous run are replayed first.
+type Spool struct {
+	ctx         context.Context
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	overflow    string
+	syncWrites  bool
+	mutex       *sync.Mutex
+	cond        *sync.Cond
+	segments    []*spoolSegment // oldest first, the last one is written to
+	size        int64
+	seq         uint64
+	reading     int   // index in segments of the segment being read
+	readOffset  int64 // offset in segments[reading] of the next frame
+	readFile    *os.File
+	closed      bool
+}
+
+type spoolSegment struct {
+	path    string
+	file    *os.File // nil once sealed
+	size    int64
+	records int
+	read    int // records handed to Pump's out so far
+	acked   int
+	removed bool
+}
+
+func newSpoolFromOptions(ctx context.Context, streamName string, opts map[string]string) *Spool {
+
+	dir, ok := opts["spool_dir"]
+	if !ok || dir == "" {
+		return nil
+	}
+
+	maxSize := SPOOL_MAX_SIZE_DEFAULT
+	segmentSize := SPOOL_SEGMENT_SIZE_DEFAULT
+	overflow := SPOOL_OVERFLOW_BLOCK
+	syncWrites := true
+
+	for key, val := range opts {
+		switch key {
+		case "spool_max_size":
+			i, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			maxSize = i
+		case "spool_segment_size":
+			i, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			segmentSize = i
+		case "spool_overflow":
+			if val != SPOOL_OVERFLOW_BLOCK && val != SPOOL_OVERFLOW_DROP_OLDEST {
+				log.Fatalf("spool_overflow %s not supported", val)
+			}
+			overflow = val
+		case "spool_sync":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			syncWrites = b
+		}
+	}
+
+	// the oldest segment has to be sealed before it can be freed so there
+	// must be room for a few of them
+	if segmentSize > maxSize/4 {
+		segmentSize = maxSize / 4
+	}
+
+	s, err := NewSpool(ctx, filepath.Join(dir, streamName), maxSize, segmentSize, overflow, syncWrites)
+	if err != nil {
+		log.WithField("stream", streamName).Fatalf("unable to open spool. %s", err.Error())
+	}
+
+	return s
+}
+
+func NewSpool(ctx context.Context, dir string, maxSize, segmentSize int64, overflow string, syncWrites bool) (*Spool, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		ctx:         ctx,
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		overflow:    overflow,
+		syncWrites:  syncWrites,
+		mutex:       new(sync.Mutex),
+	}
+	s.cond = sync.NewCond(s.mutex)
+
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+
+	if len(s.segments) > 0 {
+		log.WithField("file", dir).Warnf("replaying %d spooled segments (%d bytes)", len(s.segments), s.size)
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	}()
+
+	return s, nil
+}
+
+// loadSegments picks up segments from a previous run. They are all sealed,
+// new records go to a new segment.
+func (s *Spool) loadSegments() error {
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+
+		seg := &spoolSegment{path: filepath.Join(s.dir, name)}
+		if err := seg.scan(); err != nil {
+			return err
+		}
+
+		if seg.records == 0 {
+			os.Remove(seg.path)
+			continue
+		}
+
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+
+	return nil
+}
+
+// scan counts the complete frames in a segment. A frame cut short by a
+// crash is truncated away.
+func (seg *spoolSegment) scan() error {
+
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		_, n, err := readFrame(f, seg.size)
+		if err != nil {
+			break
+		}
+		seg.size += n
+		seg.records += 1
+	}
+
+	return f.Truncate(seg.size)
+}
+
+// Write appends a record to the spool and acks it once it is on disk,
+// synced unless spool_sync is false.
+func (s *Spool) Write(data []byte, ack func()) error {
+
+	frameSize := int64(len(data) + 4)
+	if frameSize > s.maxSize {
+		return ErrSpoolTooLarge
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.size+frameSize > s.maxSize {
+
+		if s.closed {
+			return ErrSpoolClosed
+		}
+
+		if s.overflow == SPOOL_OVERFLOW_DROP_OLDEST {
+			if len(s.segments) == 1 {
+				s.seal()
+			}
+			if len(s.segments) == 0 {
+				// sealing freed the only segment, there's nothing left to drop
+				break
+			}
+			oldest := s.segments[0]
+			log.WithField("file", s.dir).Warnf("spool full. dropping %d records", oldest.records-oldest.acked)
+			s.remove(oldest)
+			continue
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return ErrSpoolClosed
+		default:
+		}
+
+		// a fully acked segment that is still being written to can't be
+		// freed until it's sealed
+		if active := s.active(); active != nil && active.records > 0 && active.acked >= active.records {
+			s.seal()
+			continue
+		}
+
+		s.cond.Wait()
+	}
+
+	seg := s.active()
+	if seg == nil || seg.size+frameSize > s.segmentSize {
+		s.seal()
+		var err error
+		if seg, err = s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, frameSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	if _, err := seg.file.Write(frame); err != nil {
+		return err
+	}
+	if s.syncWrites {
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	seg.size += frameSize
+	seg.records += 1
+	s.size += frameSize
+	s.cond.Broadcast()
+
+	ack()
+	return nil
+}
+
+// Pump reads spooled records in order and sends them to out. The ack of
+// each record marks it delivered in the spool.
+func (s *Spool) Pump(out chan encodedRecord) {
+
+	for {
+
+		s.mutex.Lock()
+		seg, offset, ok := s.next()
+		for !ok {
+			if s.closed || s.ctx.Err() != nil {
+				s.mutex.Unlock()
+				return
+			}
+			s.cond.Wait()
+			seg, offset, ok = s.next()
+		}
+
+		data, n, err := readFrame(s.readFile, offset)
+		if err != nil {
+			// the segment is corrupt, skip the rest of it. The records that
+			// were read are all it has left to ack.
+			log.WithField("file", seg.path).Errorf("unable to read spool segment, %d records lost. %s", seg.records-seg.read, err.Error())
+			s.readOffset = seg.size
+			seg.records = seg.read
+			if seg.file == nil && seg.acked >= seg.records {
+				s.remove(seg)
+			}
+			s.mutex.Unlock()
+			continue
+		}
+		s.readOffset += n
+		seg.read += 1
+		s.mutex.Unlock()
+
+		select {
+		case out <- encodedRecord{data, s.ackFunc(seg)}:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// next returns the segment and offset of the next frame to read, moving to
+// the next segment once a sealed one has been read completely.
+func (s *Spool) next() (*spoolSegment, int64, bool) {
+
+	for s.reading < len(s.segments) {
+
+		seg := s.segments[s.reading]
+		if s.readFile == nil || s.readFile.Name() != seg.path {
+			if s.readFile != nil {
+				s.readFile.Close()
+			}
+			f, err := os.Open(seg.path)
+			if err != nil {
+				log.WithField("file", seg.path).Errorf("unable to open spool segment. %s", err.Error())
+				return nil, 0, false
+			}
+			s.readFile = f
+		}
+
+		if s.readOffset < seg.size {
+			return seg, s.readOffset, true
+		}
+
+		if seg.file != nil || s.reading == len(s.segments)-1 {
+			// still being written to
+			return nil, 0, false
+		}
+
+		s.reading += 1
+		s.readOffset = 0
+	}
+
+	return nil, 0, false
+}
+
+func (s *Spool) ackFunc(seg *spoolSegment) func() {
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if seg.removed {
+			return
+		}
+
+		seg.acked += 1
+		if seg.file == nil && seg.acked >= seg.records {
+			s.remove(seg)
+		}
+		s.cond.Broadcast()
+	}
+}
+
+func (s *Spool) active() *spoolSegment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	if seg := s.segments[len(s.segments)-1]; seg.file != nil {
+		return seg
+	}
+	return nil
+}
+
+func (s *Spool) newSegment() (*spoolSegment, error) {
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.seq += 1
+
+	seg := &spoolSegment{path: path, file: f}
+	s.segments = append(s.segments, seg)
+
+	return seg, nil
+}
+
+// seal stops writing to the active segment. If everything in it was
+// already delivered it's removed right away.
+func (s *Spool) seal() {
+
+	seg := s.active()
+	if seg == nil {
+		return
+	}
+
+	seg.file.Sync()
+	seg.file.Close()
+	seg.file = nil
+
+	if seg.acked >= seg.records {
+		s.remove(seg)
+	}
+}
+
+func (s *Spool) remove(seg *spoolSegment) {
+
+	idx := -1
+	for i, other := range s.segments {
+		if other == seg {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return
+	}
+
+	if seg.file != nil {
+		seg.file.Close()
+		seg.file = nil
+	}
+
+	if idx < s.reading {
+		s.reading -= 1
+	} else if idx == s.reading {
+		s.readOffset = 0
+		if s.readFile != nil {
+			s.readFile.Close()
+			s.readFile = nil
+		}
+	}
+
+	s.segments = append(s.segments[:idx], s.segments[idx+1:]...)
+	s.size -= seg.size
+	seg.removed = true
+
+	if err := os.Remove(seg.path); err != nil {
+		log.WithField("file", seg.path).Errorf("unable to remove spool segment. %s", err.Error())
+	}
+
+	s.cond.Broadcast()
+}
+
+func (s *Spool) Close() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seg := s.active(); seg != nil {
+		seg.file.Sync()
+		seg.file.Close()
+		seg.file = nil
+	}
+
+	if s.readFile != nil {
+		s.readFile.Close()
+		s.readFile = nil
+	}
+
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func readFrame(f *os.File, offset int64) ([]byte, int64, error) {
+
+	header := make([]byte, 4)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := f.ReadAt(data, offset+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	return data, int64(len(data) + 4), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpoolReplaysUndelivered(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "spool_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spool, err := NewSpool(ctx, dir, 1<<20, 64, SPOOL_OVERFLOW_BLOCK, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	acked := 0
+	for i := 0; i < 10; i++ {
+		if err := spool.Write([]byte(fmt.Sprintf("record %d\n", i)), func() { acked += 1 }); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if acked != 10 {
+		t.Fatalf("expected 10 records acked once spooled, got %d", acked)
+	}
+
+	out := make(chan encodedRecord)
+	go spool.Pump(out)
+	for i := 0; i < 4; i++ {
+		r := <-out
+		if string(r.data) != fmt.Sprintf("record %d\n", i) {
+			t.Fatalf("unexpected record %q", r.data)
+		}
+		r.ack()
+	}
+	cancel()
+	spool.Close()
+
+	// delivered segments are gone, what's left is replayed in order
+	spool, err = NewSpool(context.Background(), dir, 1<<20, 64, SPOOL_OVERFLOW_BLOCK, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer spool.Close()
+
+	out = make(chan encodedRecord)
+	go spool.Pump(out)
+	first := <-out
+	if string(first.data) != "record 4\n" {
+		t.Fatalf("expected replay to start at record 4, got %q", first.data)
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "spool_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := NewSpool(context.Background(), dir, 128, 32, SPOOL_OVERFLOW_DROP_OLDEST, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer spool.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := spool.Write([]byte(fmt.Sprintf("record %02d\n", i)), func() {}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if spool.size > 128 {
+		t.Fatalf("spool grew to %d bytes", spool.size)
+	}
+
+	out := make(chan encodedRecord)
+	go spool.Pump(out)
+	if r := <-out; string(r.data) == "record 00\n" {
+		t.Fatal("oldest record was not dropped")
+	}
+}
+
+func TestSpoolDropOldestAfterSeal(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "spool_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := NewSpool(context.Background(), dir, 32, 1<<20, SPOOL_OVERFLOW_DROP_OLDEST, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer spool.Close()
+
+	out := make(chan encodedRecord)
+	go spool.Pump(out)
+	for i := 0; i < 2; i++ {
+		spool.Write([]byte(fmt.Sprintf("record %d\n", i)), func() {})
+		(<-out).ack()
+	}
+
+	// the only segment is fully acked, sealing it makes room
+	if err := spool.Write([]byte("record 2\n"), func() {}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if r := <-out; string(r.data) != "record 2\n" {
+		t.Fatalf("unexpected record %q", r.data)
+	}
+}
+
+func TestSpoolFreesCorruptSegment(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "spool_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// three 13 byte frames per segment
+	spool, err := NewSpool(context.Background(), dir, 1<<20, 39, SPOOL_OVERFLOW_BLOCK, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer spool.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := spool.Write([]byte(fmt.Sprintf("record %d\n", i)), func() {}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// make the second frame of the first segment run past its end
+	corrupt := spool.segments[0]
+	f, err := os.OpenFile(corrupt.path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0x00}, 13)
+	f.Close()
+
+	out := make(chan encodedRecord)
+	go spool.Pump(out)
+	for _, want := range []string{"record 0\n", "record 3\n"} {
+		r := <-out
+		if string(r.data) != want {
+			t.Fatalf("expected %q, got %q", want, r.data)
+		}
+		r.ack()
+	}
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if !corrupt.removed {
+		t.Fatalf("expected the corrupt segment to be freed, %d of %d records acked", corrupt.acked, corrupt.records)
+	}
+}
+
+func TestSpoolSyncOption(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pushr-spool")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if s := newSpoolFromOptions(ctx, "synced", map[string]string{"spool_dir": dir}); !s.syncWrites {
+		t.Errorf("expected records to be synced before they are acked by default")
+	}
+	if s := newSpoolFromOptions(ctx, "unsynced", map[string]string{"spool_dir": dir, "spool_sync": "false"}); s.syncWrites {
+		t.Errorf("expected spool_sync false to ack records without syncing")
+	}
+}
@@ -15,6 +15,9 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"pushr/tail"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -53,22 +56,45 @@ func loadStateFile(path string) map[string]Logfile {
 			break
 		}
 
-		if len(record) == 3 {
+		// older state files only have filename, timestamp and app_ver, or
+		// no journal cursor
+		if len(record) == 3 || len(record) == 7 || len(record) == 8 {
 
-			timeParsed, err := time.Parse(ISO_8601, record[1])
-			if err != nil {
-				log.WithField("file", path).Error("Unable to parse state time for line: %v", record)
-				continue
+			var timeParsed time.Time
+			if record[1] != "" {
+				timeParsed, err = time.Parse(ISO_8601, record[1])
+				if err != nil {
+					log.WithField("file", path).Errorf("Unable to parse state time for line: %v", record)
+					continue
+				}
 			}
 
 			l := Logfile{
 				Filename:      record[0],
 				LastTimestamp: timeParsed,
 			}
+
+			if len(record) >= 7 && record[3] != "" {
+				l.Checkpoint, err = parseCheckpoint(record[3:])
+				if err != nil {
+					log.WithField("file", path).Errorf("Unable to parse checkpoint for line: %v. %s", record, err.Error())
+					continue
+				}
+			}
+
+			if len(record) == 8 {
+				l.Cursor = record[7]
+			}
+
 			state[record[0]] = l
 			setAppVer(record[2])
 
-			gUpdateCacheChan <- UpdateMessage{record[0], timeParsed}
+			gUpdateCacheChan <- UpdateMessage{
+				Filename:           record[0],
+				LastEventTimestamp: timeParsed,
+				Checkpoint:         l.Checkpoint,
+				Cursor:             l.Cursor,
+			}
 		}
 	}
 
@@ -92,6 +118,125 @@ func handleSignal(cancel context.CancelFunc) {
 type UpdateMessage struct {
 	Filename           string
 	LastEventTimestamp time.Time
+	Checkpoint         *tail.Checkpoint
+	Cursor             string // journal cursor, for journald inputs
+}
+
+func parseCheckpoint(fields []string) (*tail.Checkpoint, error) {
+
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	ino, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tail.Checkpoint{
+		Offset:      offset,
+		Dev:         dev,
+		Ino:         ino,
+		Fingerprint: fields[3],
+	}, nil
+}
+
+// checkpointTracker keeps the checkpoints of a file in the order the lines
+// were read and only sends one to the state file once every record up to
+// it has been acked.
+type checkpointTracker struct {
+	filename  string
+	mutex     *sync.Mutex
+	pending   []*trackedCheckpoint
+	stateless bool // stdin and pipes can't be resumed, nothing goes to the state file
+}
+
+type trackedCheckpoint struct {
+	checkpoint    *tail.Checkpoint
+	cursor        string
+	eventDatetime *time.Time
+	outstanding   int
+}
+
+func newCheckpointTracker(filename string) *checkpointTracker {
+	return &checkpointTracker{
+		filename: filename,
+		mutex:    new(sync.Mutex),
+	}
+}
+
+// track adds the checkpoint after a line that produced the given number of
+// records. The returned func has to be called once per record when it is
+// acked, it is nil when there are no records to wait for.
+func (t *checkpointTracker) track(cp tail.Checkpoint, eventDatetime *time.Time, records int) func() {
+	return t.add(&trackedCheckpoint{
+		checkpoint:    &cp,
+		eventDatetime: eventDatetime,
+		outstanding:   records,
+	})
+}
+
+// trackCursor is track for inputs that resume from a journal cursor
+// instead of a file offset.
+func (t *checkpointTracker) trackCursor(cursor string, eventDatetime *time.Time, records int) func() {
+	return t.add(&trackedCheckpoint{
+		cursor:        cursor,
+		eventDatetime: eventDatetime,
+		outstanding:   records,
+	})
+}
+
+func (t *checkpointTracker) add(entry *trackedCheckpoint) func() {
+
+	t.mutex.Lock()
+	t.pending = append(t.pending, entry)
+	t.commit()
+	t.mutex.Unlock()
+
+	if entry.outstanding == 0 {
+		return nil
+	}
+
+	return func() {
+		t.mutex.Lock()
+		entry.outstanding -= 1
+		t.commit()
+		t.mutex.Unlock()
+	}
+}
+
+// commit sends the newest checkpoint with nothing outstanding before it.
+// It's called with the mutex held so updates for a file are sent in order.
+func (t *checkpointTracker) commit() {
+
+	var update *UpdateMessage
+	for len(t.pending) > 0 && t.pending[0].outstanding <= 0 {
+		entry := t.pending[0]
+		t.pending = t.pending[1:]
+
+		if update == nil {
+			update = &UpdateMessage{Filename: t.filename}
+		}
+		if entry.checkpoint != nil {
+			update.Checkpoint = entry.checkpoint
+		}
+		if entry.cursor != "" {
+			update.Cursor = entry.cursor
+		}
+		if entry.eventDatetime != nil {
+			update.LastEventTimestamp = *entry.eventDatetime
+		}
+	}
+
+	if update != nil && !t.stateless {
+		gUpdateCacheChan <- *update
+	}
 }
 
 func updateStateFileInterval(ctx context.Context) {
@@ -104,13 +249,7 @@ LOOP:
 	for {
 		select {
 		case updateMessage := <-gUpdateCacheChan:
-			if l, ok := logfilesMap[updateMessage.Filename]; ok {
-				if !updateMessage.LastEventTimestamp.IsZero() {
-					l.LastEventTimestamp = updateMessage.LastEventTimestamp
-				}
-			} else {
-				logfilesMap[updateMessage.Filename] = &updateMessage
-			}
+			mergeUpdateMessage(logfilesMap, updateMessage)
 		case <-t.C:
 			if len(logfilesMap) > 0 {
 				saveStateFile(logfilesMap)
@@ -119,16 +258,46 @@ LOOP:
 			break LOOP
 		}
 	}
+
+	// pick up acks that arrived while shutting down
+DRAIN:
+	for {
+		select {
+		case updateMessage := <-gUpdateCacheChan:
+			mergeUpdateMessage(logfilesMap, updateMessage)
+		default:
+			break DRAIN
+		}
+	}
+
 	saveStateFile(logfilesMap)
 }
 
+func mergeUpdateMessage(logfilesMap map[string]*UpdateMessage, updateMessage UpdateMessage) {
+	if l, ok := logfilesMap[updateMessage.Filename]; ok {
+		if !updateMessage.LastEventTimestamp.IsZero() {
+			l.LastEventTimestamp = updateMessage.LastEventTimestamp
+		}
+		if updateMessage.Checkpoint != nil {
+			l.Checkpoint = updateMessage.Checkpoint
+		}
+		if updateMessage.Cursor != "" {
+			l.Cursor = updateMessage.Cursor
+		}
+	} else {
+		logfilesMap[updateMessage.Filename] = &updateMessage
+	}
+}
+
 func saveStateFile(logfiles map[string]*UpdateMessage) {
 
-	f, err := os.Create(gStateFilePath)
+	// write to a temp file and rename it so a crash mid-write doesn't
+	// leave a truncated state file behind
+	tmpPath := gStateFilePath + ".tmp"
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
 
 	csvWriter := csv.NewWriter(f)
 
@@ -143,10 +312,34 @@ func saveStateFile(logfiles map[string]*UpdateMessage) {
 			logFilepath,
 			timestr,
 			appVer(),
+			"", "", "", "",
+			logFile.Cursor,
+		}
+
+		if cp := logFile.Checkpoint; cp != nil {
+			vals[3] = strconv.FormatInt(cp.Offset, 10)
+			vals[4] = strconv.FormatUint(cp.Dev, 10)
+			vals[5] = strconv.FormatUint(cp.Ino, 10)
+			vals[6] = cp.Fingerprint
 		}
+
 		csvWriter.Write(vals)
 	}
 
 	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		f.Close()
+		log.WithField("file", tmpPath).Errorf("unable to write state file. %s", err.Error())
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		log.WithField("file", tmpPath).Errorf("unable to write state file. %s", err.Error())
+		return
+	}
+
+	if err := os.Rename(tmpPath, gStateFilePath); err != nil {
+		log.WithField("file", gStateFilePath).Errorf("unable to replace state file. %s", err.Error())
+	}
 
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pushr/tail"
+	"testing"
+	"time"
+)
+
+func TestCheckpointTrackerWaitsForAcks(t *testing.T) {
+
+	tracker := newCheckpointTracker("test-input")
+
+	ack1 := tracker.track(tail.Checkpoint{Offset: 10}, nil, 1)
+	tracker.track(tail.Checkpoint{Offset: 20}, nil, 0)
+	ack3 := tracker.track(tail.Checkpoint{Offset: 30}, nil, 1)
+
+	// acking the later record first must not move the checkpoint
+	ack3()
+	select {
+	case m := <-gUpdateCacheChan:
+		t.Fatalf("checkpoint advanced to %d before the first record was acked", m.Checkpoint.Offset)
+	default:
+	}
+
+	ack1()
+	m := <-gUpdateCacheChan
+	if m.Filename != "test-input" || m.Checkpoint.Offset != 30 {
+		t.Fatalf("expected checkpoint at 30 for test-input, got %d for %s", m.Checkpoint.Offset, m.Filename)
+	}
+
+	tracker.track(tail.Checkpoint{Offset: 40}, nil, 0)
+	if m := <-gUpdateCacheChan; m.Checkpoint.Offset != 40 {
+		t.Fatalf("expected checkpoint at 40, got %d", m.Checkpoint.Offset)
+	}
+}
+
+func TestCheckpointAdvancesPastDroppedRecords(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for len(gUpdateCacheChan) > 0 {
+		<-gUpdateCacheChan
+	}
+
+	format := []Attribute{{"log_line", "string", 0, "", ""}}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewHTTPStream(ctx, format, server.URL, "", "test", []string{
+		"max_retry: 0",
+		"buffer_interval: 60",
+	})
+
+	tracker := newCheckpointTracker("dropped-input")
+	for i, line := range []string{"GET /a", "GET /b"} {
+		r := NewRecord(line, format, map[string]string{"log_line": line})
+		r.SetAck(tracker.track(tail.Checkpoint{Offset: int64(10 * (i + 1))}, nil, 1))
+		s.Stream(r)
+	}
+
+	// the batch is given up on after the first retry
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	s.Close()
+
+	var last UpdateMessage
+	for len(gUpdateCacheChan) > 0 {
+		last = <-gUpdateCacheChan
+	}
+	if last.Checkpoint == nil || last.Checkpoint.Offset != 20 {
+		t.Fatalf("expected the checkpoint to move past the dropped records, got %+v", last.Checkpoint)
+	}
+	if len(tracker.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %d checkpoints", len(tracker.pending))
+	}
+}
+
+func TestStateFileCursor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pushr-state")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { gStateFilePath = path }(gStateFilePath)
+	gStateFilePath = filepath.Join(dir, "pushr.state")
+
+	tracker := newCheckpointTracker("journald:system")
+	tracker.trackCursor("s=abc;i=1", nil, 1)()
+	m := <-gUpdateCacheChan
+	if m.Cursor != "s=abc;i=1" || m.Checkpoint != nil {
+		t.Fatalf("expected the cursor to be committed, got %+v", m)
+	}
+
+	saveStateFile(map[string]*UpdateMessage{m.Filename: &m})
+	state := loadStateFile(gStateFilePath)
+	<-gUpdateCacheChan
+
+	if l, ok := state["journald:system"]; !ok || l.Cursor != "s=abc;i=1" || l.Checkpoint != nil {
+		t.Fatalf("expected the cursor to be restored, got %+v", state)
+	}
+}
@@ -48,6 +48,10 @@ func (s *CSVStream) Stream(data *Record) error {
 	_, err := s.file.Write(data.RecordToCSV())
 	s.mutex.Unlock()
 
+	if err == nil {
+		data.Ack()
+	}
+
 	return err
 }
 
@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ES_BULK_SIZE_DEFAULT  = 500
+	ES_BULK_BYTES_DEFAULT = 5 << 20 // 5MB
+	ES_MAX_RETRY_DEFAULT  = 5
+	ES_REQUEST_TIMEOUT    = time.Second * 30
+)
+
+var esIndexDateRegex = regexp.MustCompile(`\{([^\}]*)\}`)
+
+// ElasticsearchStream indexes records as typed documents through the _bulk
+// API. It works against Elasticsearch and OpenSearch.
+type ElasticsearchStream struct {
+	ctx          context.Context
+	wg           sync.WaitGroup
+	client       *http.Client
+	url          string
+	index        string // time layouts in braces are replaced, e.g. app-log-{2006.01.02}
+	docType      string
+	username     string
+	password     string
+	apiKey       string
+	bulkSize     int
+	bulkBytes    int
+	interval     time.Duration
+	maxRetry     int
+	dataChan     chan esDocument
+	recordFormat []Attribute
+}
+
+type esDocument struct {
+	action []byte
+	source []byte
+	ack    func()
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func NewElasticsearchStream(ctx context.Context, recordFormat []Attribute, url, streamName string, options []string) *ElasticsearchStream {
+
+	opts := ParseOptions(options)
+	s := parseElasticsearchOptions(opts)
+
+	if s.url == "" {
+		s.url = url
+	}
+	if s.url == "" {
+		log.Fatalf("elasticsearch stream %s needs a url", streamName)
+	}
+	s.url = strings.TrimRight(s.url, "/")
+
+	if s.index == "" {
+		s.index = streamName + "-{2006.01.02}"
+	}
+
+	s.ctx = ctx
+	s.client = &http.Client{
+		Timeout: ES_REQUEST_TIMEOUT,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: parseTLSOptions(opts),
+		},
+	}
+	s.dataChan = make(chan esDocument, s.bulkSize*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *ElasticsearchStream) Stream(r *Record) error {
+
+	doc := r.RecordToMap()
+
+	// timestamps are indexed as ISO 8601 whatever the destination format
+	eventTime := time.Now().UTC()
+	for _, attr := range s.recordFormat {
+		if attr.Type != "timestamp" {
+			continue
+		}
+		layout := ISO_8601
+		if attr.SourceTimestampFormat != "" {
+			layout = attr.SourceTimestampFormat
+		}
+		if t, err := time.Parse(layout, r.EventAttributes[attr.Key]); err == nil {
+			doc[attr.Key] = t.UTC().Format(ISO_8601)
+			if attr.Key == "event_datetime" {
+				eventTime = t.UTC()
+			}
+		}
+	}
+
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	meta := map[string]string{"_index": s.indexName(eventTime)}
+	if s.docType != "" {
+		meta["_type"] = s.docType
+	}
+	action, _ := json.Marshal(map[string]interface{}{"index": meta})
+
+	s.dataChan <- esDocument{action, source, r.Ack}
+	return nil
+}
+
+func (s *ElasticsearchStream) indexName(t time.Time) string {
+	return esIndexDateRegex.ReplaceAllStringFunc(s.index, func(m string) string {
+		return t.Format(m[1 : len(m)-1])
+	})
+}
+
+func (s *ElasticsearchStream) Close() {
+	s.wg.Wait()
+}
+
+func (s *ElasticsearchStream) intervalStreamer() {
+
+	docs := []esDocument{}
+	sizeAccumulator := 0
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case doc := <-s.dataChan:
+			docs = append(docs, doc)
+			sizeAccumulator += len(doc.action) + len(doc.source) + 2
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(docs) >= s.bulkSize || sizeAccumulator >= s.bulkBytes || flush) && len(docs) > 0 {
+			s.bulk(docs, 0)
+			docs = []esDocument{}
+			sizeAccumulator = 0
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+func (s *ElasticsearchStream) bulk(docs []esDocument, failCount int) {
+	s.wg.Add(1)
+	go s._bulk(docs, failCount)
+}
+
+func (s *ElasticsearchStream) _bulk(docs []esDocument, failCount int) {
+
+	defer s.wg.Done()
+
+	if failCount > s.maxRetry {
+		dropRecords(esDocumentAcks(docs), "retry count exceeded %v for elasticsearch documents", s.maxRetry)
+		return
+	}
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v documents in %v seconds", len(docs), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	body := bytes.Buffer{}
+	for _, doc := range docs {
+		body.Write(doc.action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", s.url+"/_bulk", &body)
+	if err != nil {
+		dropRecords(esDocumentAcks(docs), "unable to create bulk request: %s", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Errorf("error sending bulk request: %s", err.Error())
+		s.bulk(docs, failCount+1)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("bulk request failed with %d: %s", resp.StatusCode, truncateString(string(respBody), 512))
+		s.bulk(docs, failCount+1)
+		return
+	}
+
+	bulkResp := esBulkResponse{}
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil || len(bulkResp.Items) != len(docs) {
+		log.Errorf("unexpected bulk response: %s", truncateString(string(respBody), 512))
+		s.bulk(docs, failCount+1)
+		return
+	}
+
+	retry := []esDocument{}
+	rejected := []func(){}
+	for i, item := range bulkResp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status < 300:
+				docs[i].ack()
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				retry = append(retry, docs[i])
+			default:
+				// mapping errors and the like won't go through on a retry
+				log.Warnf("document rejected with %d: %s", result.Status, result.Error)
+				rejected = append(rejected, docs[i].ack)
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		dropRecords(rejected, "elasticsearch rejected %d of %d documents", len(rejected), len(docs))
+	}
+
+	if len(retry) > 0 {
+		s.bulk(retry, failCount+1)
+		return
+	}
+
+	if failCount > 0 {
+		log.Warnf("%v documents succeeded after %v retries", len(docs), failCount)
+	}
+}
+
+func esDocumentAcks(docs []esDocument) []func() {
+	acks := make([]func(), 0, len(docs))
+	for _, doc := range docs {
+		acks = append(acks, doc.ack)
+	}
+	return acks
+}
+
+func (s *ElasticsearchStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseElasticsearchOptions(opts map[string]string) *ElasticsearchStream {
+
+	s := &ElasticsearchStream{
+		bulkSize:  ES_BULK_SIZE_DEFAULT,
+		bulkBytes: ES_BULK_BYTES_DEFAULT,
+		interval:  time.Second * 5,
+		maxRetry:  ES_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "url":
+			s.url = val
+		case "index":
+			s.index = val
+		case "doc_type":
+			s.docType = val
+		case "username":
+			s.username = val
+		case "password":
+			s.password = val
+		case "api_key":
+			s.apiKey = val
+		case "bulk_size":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.bulkSize = i
+		case "bulk_bytes":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.bulkBytes = i
+		case "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		default:
+			break
+		}
+	}
+
+	if s.bulkSize < 1 {
+		log.Fatalf("bulk_size must be positive, got %d", s.bulkSize)
+	}
+
+	return s
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchBulk(t *testing.T) {
+
+	requests := make(chan []map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); req.URL.Path != "/_bulk" || user != "pushr" || pass != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lines := []map[string]interface{}{}
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			line := map[string]interface{}{}
+			json.Unmarshal(scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+		requests <- lines
+		// the second document is rejected, the third is throttled
+		fmt.Fprint(rw, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},{"index":{"status":429}}]}`)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewElasticsearchStream(ctx, testFormat, server.URL, "app-log", []string{"username: pushr", "password: secret", "bulk_size: 3"})
+
+	acked := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		n := i
+		r := NewRecord("", testFormat, map[string]string{"event_datetime": "2026-10-17T10:00:00Z", "response_bytes": fmt.Sprint(i), "log_line": "GET /"})
+		r.SetAck(func() { acked <- n })
+		s.Stream(r)
+	}
+
+	lines := <-requests
+	if len(lines) != 6 {
+		t.Fatalf("expected 3 actions and 3 documents, got %d lines", len(lines))
+	}
+	if index := lines[0]["index"].(map[string]interface{})["_index"]; index != "app-log-2026.10.17" {
+		t.Fatalf("unexpected index %v", index)
+	}
+	if lines[1]["response_bytes"] != float64(0) || lines[1]["event_datetime"] != "2026-10-17T10:00:00Z" {
+		t.Fatalf("unexpected document %v", lines[1])
+	}
+
+	for _, expected := range []int{0, 1} {
+		select {
+		case n := <-acked:
+			if n != expected {
+				t.Fatalf("expected document %d acked, got %d", expected, n)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("document %d not acked", expected)
+		}
+	}
+
+	select {
+	case n := <-acked:
+		t.Fatalf("throttled document %d acked", n)
+	default:
+	}
+}
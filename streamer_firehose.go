@@ -12,9 +12,6 @@ import (
 	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"math"
 	"sync"
@@ -29,46 +26,35 @@ var (
 type FirehoseStream struct {
 	svc          *firehose.Firehose
 	stream       string
-	dataChan     chan []byte
+	dataChan     chan encodedRecord
 	interval     time.Duration
 	recordFormat []Attribute
 	ctx          context.Context
 	wg           sync.WaitGroup
+	spool        *Spool
 }
 
-func NewFirehoseStream(ctx context.Context, recordFormat []Attribute, accessKey, secretAccessKey, awsRegion, awsSTSRole, streamName string) *FirehoseStream {
+func NewFirehoseStream(ctx context.Context, recordFormat []Attribute, accessKey, secretAccessKey, awsRegion, awsSTSRole, streamName string, options []string) *FirehoseStream {
 
 	if awsRegion == "" {
 		log.Fatal("Please Specify the region your firehose is.")
 	}
 
 	s := &FirehoseStream{}
-	sess := &session.Session{}
-	awsConfig := &aws.Config{Region: aws.String(awsRegion)}
-
-	if awsSTSRole != "" {
-		sess = session.Must(session.NewSession())
-		creds := stscreds.NewCredentials(sess, awsSTSRole)
-		awsConfig.Credentials = creds
-	} else if accessKey == "" || secretAccessKey == "" {
-		// try IAM
-		sess = session.New(nil)
-	} else {
-		creds := credentials.NewStaticCredentials(accessKey, secretAccessKey, "")
-		config := &aws.Config{
-			Region:      aws.String(awsRegion),
-			Credentials: creds,
-		}
-		sess = session.New(config)
-	}
+	sess, awsConfig := newAWSSession(accessKey, secretAccessKey, awsRegion, awsSTSRole, "")
 
 	s.svc = firehose.New(sess, awsConfig)
 	s.stream = streamName
-	s.dataChan = make(chan []byte, BATCH_LIMIT*5)
+	s.dataChan = make(chan encodedRecord, BATCH_LIMIT*5)
 	s.interval = 5 * time.Second
 	s.recordFormat = recordFormat
 	s.ctx = ctx
 
+	s.spool = newSpoolFromOptions(ctx, streamName, ParseOptions(options))
+	if s.spool != nil {
+		go s.spool.Pump(s.dataChan)
+	}
+
 	s.wg.Add(1)
 	go s.intervalStreamer()
 
@@ -76,17 +62,24 @@ func NewFirehoseStream(ctx context.Context, recordFormat []Attribute, accessKey,
 }
 
 func (s *FirehoseStream) Stream(r *Record) error {
-	s.dataChan <- r.RecordToCSV()
+	if s.spool != nil {
+		return s.spool.Write(r.RecordToCSV(), r.Ack)
+	}
+	s.dataChan <- encodedRecord{r.RecordToCSV(), r.Ack}
 	return nil
 }
 
 func (s *FirehoseStream) Close() {
 	s.wg.Wait()
+	if s.spool != nil {
+		s.spool.Close()
+	}
 }
 
 func (s *FirehoseStream) intervalStreamer() {
 
 	accum := []*firehose.Record{}
+	acks := []func(){}
 	sizeAccumulator := 0
 	timer := time.NewTicker(s.interval)
 	exit := false
@@ -94,11 +87,13 @@ LOOP:
 	for {
 
 		data := []byte{}
+		var ack func()
 		flush := false
 
 		select {
 		case incomingData := <-s.dataChan:
-			data = incomingData
+			data = incomingData.data
+			ack = incomingData.ack
 		case <-timer.C:
 			flush = true
 			data = nil
@@ -112,7 +107,8 @@ LOOP:
 		if data != nil {
 
 			if len(data) > 1000000 {
-				log.Printf("Data recorded exceeded 1MB. skipping: \n--\n%s\n--", data)
+				// firehose will never take it, don't hold the checkpoint back
+				dropRecords([]func(){ack}, "firehose record over 1MB: %s", truncateString(string(data), 512))
 				continue
 			}
 
@@ -121,6 +117,7 @@ LOOP:
 				Data: data,
 			}
 			accum = append(accum, record)
+			acks = append(acks, ack)
 		}
 
 		if (len(accum) == BATCH_LIMIT || sizeAccumulator > REQUEST_SIZE_LIMIT || flush) && len(accum) > 0 {
@@ -128,9 +125,10 @@ LOOP:
 			dataCopy := make([]*firehose.Record, len(accum))
 			copy(dataCopy, accum)
 
-			s.uploadRecords(dataCopy, 0)
+			s.uploadRecords(dataCopy, acks, 0)
 
 			accum = []*firehose.Record{}
+			acks = []func(){}
 			sizeAccumulator = 0
 
 		}
@@ -144,15 +142,21 @@ LOOP:
 	}
 }
 
-func (s *FirehoseStream) uploadRecords(data []*firehose.Record, failCount int) {
+func (s *FirehoseStream) uploadRecords(data []*firehose.Record, acks []func(), failCount int) {
 	s.wg.Add(1)
-	go s._uploadRecords(data, failCount)
+	go s._uploadRecords(data, acks, failCount)
 }
 
-func (s *FirehoseStream) _uploadRecords(data []*firehose.Record, failCount int) {
+func (s *FirehoseStream) _uploadRecords(data []*firehose.Record, acks []func(), failCount int) {
 
 	defer s.wg.Done()
 
+	if failCount > 0 && s.spool != nil && s.ctx.Err() != nil {
+		// shutting down, the spool sends them again on the next run
+		log.Warnf("Leaving %v records in the spool", len(acks))
+		return
+	}
+
 	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
 	if sleepTime > time.Duration(0) {
 		log.Warnf("Retrying %v records in %v seconds", len(data), sleepTime)
@@ -167,21 +171,30 @@ func (s *FirehoseStream) _uploadRecords(data []*firehose.Record, failCount int)
 	r, err := s.svc.PutRecordBatch(params)
 	if err != nil {
 		log.Error(err.Error())
-		s.uploadRecords(data, failCount+1)
+		s.uploadRecords(data, acks, failCount+1)
 		return
 	}
 
 	if *r.FailedPutCount > 0 {
 
-		// Build a new array with the records that failed.
+		// Build a new array with the records that failed and ack the rest.
 		newData := []*firehose.Record{}
+		newAcks := []func(){}
 		for i, req := range r.RequestResponses {
 			if req.ErrorCode != nil {
 				newData = append(newData, data[i])
+				newAcks = append(newAcks, acks[i])
+			} else {
+				acks[i]()
 			}
 		}
 
-		s.uploadRecords(data, failCount+1)
+		s.uploadRecords(newData, newAcks, failCount+1)
+		return
+	}
+
+	for _, ack := range acks {
+		ack()
 	}
 
 	if failCount > 0 {
@@ -0,0 +1,412 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	HTTP_BATCH_SIZE_DEFAULT  = 500
+	HTTP_BATCH_BYTES_DEFAULT = 1 << 20 // 1MB
+	HTTP_MAX_RETRY_DEFAULT   = 5
+	HTTP_TIMEOUT_DEFAULT     = time.Second * 30
+	HTTP_HEADER_PREFIX       = "header_"
+
+	// the payload http streams used to have, still the default when a
+	// stream_api_key is configured
+	HTTP_API_KEY_TEMPLATE = `{"api_key":"{{.ApiKey}}","transaction_id":"{{.BatchId}}","events":{{.Events}}}`
+)
+
+// HTTPStream posts batches of records to any http endpoint. Records are
+// encoded as ndjson, a json array or csv and can be wrapped in a body
+// template, e.g. {"events": {{.Events}}}.
+type HTTPStream struct {
+	ctx          context.Context
+	wg           sync.WaitGroup
+	client       *http.Client
+	url          string
+	method       string
+	headers      map[string]string
+	encoding     string
+	gzip         bool
+	template     *template.Template
+	apiKey       string
+	successCodes statusCodes
+	retryCodes   statusCodes
+	dropCodes    statusCodes
+	batchSize    int
+	batchBytes   int
+	interval     time.Duration
+	maxRetry     int
+	dataChan     chan encodedRecord
+	recordFormat []Attribute
+}
+
+// httpBatch is what body templates are executed with.
+type httpBatch struct {
+	Events  string // the encoded records
+	Count   int
+	BatchId string // md5 of the records, the same when a batch is retried
+	ApiKey  string
+}
+
+// statusCodes is a set of http status codes, configured as e.g. 200-299,304
+type statusCodes [][2]int
+
+func parseStatusCodes(val string) statusCodes {
+
+	codes := statusCodes{}
+	for _, part := range omitEmpty(strings.Split(strings.Replace(val, " ", "", -1), ",")) {
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			log.Fatalf("invalid status code %s: %s", part, err.Error())
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				log.Fatalf("invalid status code %s: %s", part, err.Error())
+			}
+		}
+		codes = append(codes, [2]int{lo, hi})
+	}
+
+	return codes
+}
+
+func (c statusCodes) has(code int) bool {
+	for _, r := range c {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func NewHTTPStream(ctx context.Context, recordFormat []Attribute, url, apiKey, streamName string, options []string) *HTTPStream {
+
+	opts := ParseOptions(options)
+	s := parseHTTPOptions(opts)
+
+	if s.url == "" {
+		s.url = url
+	}
+	if s.url == "" {
+		log.Fatalf("http stream %s needs a url", streamName)
+	}
+	if s.apiKey == "" {
+		s.apiKey = apiKey
+	}
+	if s.template == nil && s.apiKey != "" {
+		s.template = template.Must(template.New(streamName).Parse(HTTP_API_KEY_TEMPLATE))
+	}
+
+	s.ctx = ctx
+	s.client = &http.Client{
+		Timeout: s.client.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: parseTLSOptions(opts),
+		},
+	}
+	s.dataChan = make(chan encodedRecord, s.batchSize*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *HTTPStream) Stream(r *Record) error {
+
+	var data []byte
+	if s.encoding == "csv" {
+		data = r.RecordToCSV()
+	} else {
+		data = r.RecordToJSON()
+	}
+
+	s.dataChan <- encodedRecord{data, r.Ack}
+	return nil
+}
+
+// Close waits for the buffered records to be flushed once the context is
+// done, and for the uploads in flight.
+func (s *HTTPStream) Close() {
+	s.wg.Wait()
+}
+
+func (s *HTTPStream) intervalStreamer() {
+
+	records := [][]byte{}
+	acks := []func(){}
+	sizeAccumulator := 0
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case data := <-s.dataChan:
+			records = append(records, data.data)
+			acks = append(acks, data.ack)
+			sizeAccumulator += len(data.data) + 1
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(records) >= s.batchSize || sizeAccumulator >= s.batchBytes || flush) && len(records) > 0 {
+			body, err := s.encode(records)
+			if err != nil {
+				// a broken template, every batch would fail the same way
+				dropRecords(acks, "unable to encode %d records: %s", len(records), err.Error())
+			} else {
+				s.send(body, acks, 0)
+			}
+			records = [][]byte{}
+			acks = []func(){}
+			sizeAccumulator = 0
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+func (s *HTTPStream) encode(records [][]byte) ([]byte, error) {
+
+	var events []byte
+	switch s.encoding {
+	case "ndjson":
+		events = bytes.Join(records, []byte("\n"))
+		events = append(events, '\n')
+	case "csv":
+		events = bytes.Join(records, nil)
+	default:
+		events = append([]byte("["), bytes.Join(records, []byte(","))...)
+		events = append(events, ']')
+	}
+
+	body := events
+	if s.template != nil {
+		h := md5.New()
+		for _, r := range records {
+			h.Write(r)
+		}
+		batch := httpBatch{
+			Events:  string(events),
+			Count:   len(records),
+			BatchId: hex.EncodeToString(h.Sum(nil)),
+			ApiKey:  s.apiKey,
+		}
+		buf := bytes.Buffer{}
+		if err := s.template.Execute(&buf, batch); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	if s.gzip {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		body = buf.Bytes()
+	}
+
+	return body, nil
+}
+
+func (s *HTTPStream) send(body []byte, acks []func(), failCount int) {
+	s.wg.Add(1)
+	go s._send(body, acks, failCount)
+}
+
+func (s *HTTPStream) _send(body []byte, acks []func(), failCount int) {
+
+	defer s.wg.Done()
+
+	if failCount > s.maxRetry {
+		dropRecords(acks, "retry count exceeded %v for %s", s.maxRetry, s.url)
+		return
+	}
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v records in %v seconds", len(acks), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	req, err := http.NewRequest(s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		dropRecords(acks, "unable to create request: %s", err.Error())
+		return
+	}
+	for key, val := range s.headers {
+		req.Header.Set(key, val)
+	}
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		log.Errorf("http err: %s", err.Error())
+		s.send(body, acks, failCount+1)
+		return
+	}
+	resBody, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	switch {
+	case s.successCodes.has(res.StatusCode):
+		if failCount > 0 {
+			log.Warnf("%v records succeeded after %v retries", len(acks), failCount)
+		}
+	case s.retryCodes.has(res.StatusCode):
+		log.Warnf("http %d: %s", res.StatusCode, truncateString(string(resBody), 512))
+		s.send(body, acks, failCount+1)
+		return
+	case s.dropCodes.has(res.StatusCode):
+		// retrying won't help
+		dropRecords(acks, "http %d: %s", res.StatusCode, truncateString(string(resBody), 512))
+		return
+	default:
+		log.Warnf("unexpected http %d: %s", res.StatusCode, truncateString(string(resBody), 512))
+		s.send(body, acks, failCount+1)
+		return
+	}
+
+	for _, ack := range acks {
+		ack()
+	}
+}
+
+func (s *HTTPStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseHTTPOptions(opts map[string]string) *HTTPStream {
+
+	s := &HTTPStream{
+		client:       &http.Client{Timeout: HTTP_TIMEOUT_DEFAULT},
+		method:       "POST",
+		headers:      map[string]string{},
+		encoding:     "json",
+		successCodes: parseStatusCodes("200-299"),
+		retryCodes:   parseStatusCodes("408,429,500-599"),
+		dropCodes:    parseStatusCodes("400-499"),
+		batchSize:    HTTP_BATCH_SIZE_DEFAULT,
+		batchBytes:   HTTP_BATCH_BYTES_DEFAULT,
+		interval:     time.Second,
+		maxRetry:     HTTP_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch {
+		case strings.HasPrefix(key, HTTP_HEADER_PREFIX):
+			s.headers[http.CanonicalHeaderKey(strings.TrimPrefix(key, HTTP_HEADER_PREFIX))] = val
+		case key == "url":
+			s.url = val
+		case key == "method":
+			s.method = strings.ToUpper(val)
+		case key == "encoding":
+			if val != "json" && val != "ndjson" && val != "csv" {
+				log.Fatalf("http encoding %s not supported", val)
+			}
+			s.encoding = val
+		case key == "compression":
+			if val != "gzip" && val != "none" {
+				log.Fatalf("http compression %s not supported", val)
+			}
+			s.gzip = val == "gzip"
+		case key == "body_template":
+			t, err := template.New(key).Parse(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.template = t
+		case key == "api_key":
+			s.apiKey = val
+		case key == "success_codes":
+			s.successCodes = parseStatusCodes(val)
+		case key == "retry_codes":
+			s.retryCodes = parseStatusCodes(val)
+		case key == "drop_codes":
+			s.dropCodes = parseStatusCodes(val)
+		case key == "batch_size":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchSize = i
+		case key == "batch_bytes":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchBytes = i
+		case key == "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case key == "timeout":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.client.Timeout = time.Duration(i) * time.Second
+		case key == "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		default:
+			break
+		}
+	}
+
+	if _, ok := s.headers["Content-Type"]; !ok {
+		s.headers["Content-Type"] = map[string]string{
+			"json":   "application/json",
+			"ndjson": "application/x-ndjson",
+			"csv":    "text/csv",
+		}[s.encoding]
+	}
+
+	return s
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPStreamTemplate(t *testing.T) {
+
+	var mu sync.Mutex
+	requests := 0
+	bodies := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests += 1
+		if r.Method != "PUT" || r.Header.Get("X-Api-Key") != "secret" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected request %s %v", r.Method, r.Header)
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		body, _ := ioutil.ReadAll(gz)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewHTTPStream(ctx, testFormat, server.URL, "", "test", []string{
+		"method: put",
+		"header_X-Api-Key: secret",
+		"encoding: ndjson",
+		"compression: gzip",
+		"body_template: {{.Count}} {{.Events}}",
+		"buffer_interval: 60",
+	})
+
+	acked := make(chan bool, 2)
+	for _, bytes := range []string{"1", "2"} {
+		r := NewRecord("", testFormat, map[string]string{"app": "web", "response_bytes": bytes, "log_line": "GET /"})
+		r.SetAck(func() { acked <- true })
+		s.Stream(r)
+	}
+
+	// nothing is sent before the interval, closing flushes the buffer
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	s.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acked:
+		default:
+			t.Fatalf("only %d of 2 records acked", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 || len(bodies) != 1 || !strings.HasPrefix(bodies[0], "2 ") {
+		t.Fatalf("expected one retry and the templated body, got %d requests %q", requests, bodies)
+	}
+	events := strings.Split(strings.TrimSuffix(bodies[0][2:], "\n"), "\n")
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %q", bodies[0])
+	}
+	for i, event := range events {
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(event), &doc); err != nil || doc["app"] != "web" || doc["response_bytes"] != float64(i+1) {
+			t.Fatalf("unexpected event %s", event)
+		}
+	}
+}
+
+func TestHTTPStatusCodes(t *testing.T) {
+
+	codes := parseStatusCodes("200-299, 304")
+	for code, want := range map[int]bool{200: true, 250: true, 299: true, 304: true, 300: false, 404: false} {
+		if codes.has(code) != want {
+			t.Errorf("expected has(%d) to be %v", code, want)
+		}
+	}
+}
+
+func TestHTTPHeaderCase(t *testing.T) {
+
+	s := parseHTTPOptions(ParseOptions([]string{
+		"encoding: ndjson",
+		"header_content-type: application/vnd.pushr+json",
+	}))
+	if len(s.headers) != 1 || s.headers["Content-Type"] != "application/vnd.pushr+json" {
+		t.Fatalf("expected the configured content type only, got %v", s.headers)
+	}
+}
+
+func TestHTTPStreamBrokenTemplate(t *testing.T) {
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+	}))
+	defer server.Close()
+
+	// the template parses, but httpBatch has no Nope
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewHTTPStream(ctx, testFormat, server.URL, "", "test", []string{
+		"body_template: {{.Nope}}",
+		"buffer_interval: 60",
+	})
+
+	acked := make(chan bool, 1)
+	r := NewRecord("", testFormat, map[string]string{"app": "web"})
+	r.SetAck(func() { acked <- true })
+	s.Stream(r)
+
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	s.Close()
+
+	select {
+	case <-acked:
+	default:
+		t.Fatal("expected the record that couldn't be encoded to be acked")
+	}
+	if requests != 0 {
+		t.Fatalf("expected no request, got %d", requests)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	KAFKA_BATCH_SIZE_DEFAULT     = 500
+	KAFKA_BATCH_BYTES_DEFAULT    = 1048576 // 1MB
+	KAFKA_BATCH_INTERVAL_DEFAULT = time.Second
+	KAFKA_MAX_RETRY_DEFAULT      = 5
+	KAFKA_WRITE_TIMEOUT          = time.Second * 30
+)
+
+type KafkaStream struct {
+	ctx            context.Context
+	wg             sync.WaitGroup
+	writer         *kafka.Writer
+	brokers        []string
+	topic          string
+	topicAttribute string
+	keyAttribute   string
+	format         string
+	batchSize      int
+	batchBytes     int
+	batchInterval  time.Duration
+	maxRetry       int
+	dataChan       chan kafkaRecord
+	recordFormat   []Attribute
+}
+
+type kafkaRecord struct {
+	msg kafka.Message
+	ack func()
+}
+
+func NewKafkaStream(ctx context.Context, recordFormat []Attribute, streamName string, options []string) *KafkaStream {
+
+	opts := ParseOptions(options)
+	s := parseKafkaOptions(opts)
+
+	if len(s.brokers) == 0 {
+		log.Fatalf("kafka stream %s needs brokers", streamName)
+	}
+
+	if s.topic == "" {
+		s.topic = streamName
+	}
+
+	transport := &kafka.Transport{
+		TLS:  parseTLSOptions(opts),
+		SASL: parseSASLOptions(opts),
+	}
+
+	var balancer kafka.Balancer = &kafka.RoundRobin{}
+	if s.keyAttribute != "" {
+		// same partitioner as the java client so keys land where consumers expect them
+		balancer = kafka.Murmur2Balancer{}
+	}
+
+	s.writer.Addr = kafka.TCP(s.brokers...)
+	s.writer.Balancer = balancer
+	s.writer.Transport = transport
+	s.writer.BatchSize = s.batchSize
+	s.writer.BatchBytes = int64(s.batchBytes)
+	// batching happens in intervalStreamer, don't wait to fill another one
+	s.writer.BatchTimeout = time.Millisecond * 10
+	s.writer.WriteTimeout = KAFKA_WRITE_TIMEOUT
+	// retries are handled here so acks only go out for delivered messages
+	s.writer.MaxAttempts = 1
+
+	s.ctx = ctx
+	s.dataChan = make(chan kafkaRecord, s.batchSize*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *KafkaStream) Stream(r *Record) error {
+
+	msg := kafka.Message{Topic: s.topic}
+	if s.topicAttribute != "" {
+		if topic := r.EventAttributes[s.topicAttribute]; !isUnset(topic) {
+			msg.Topic = topic
+		}
+	}
+
+	if s.keyAttribute != "" {
+		if key := r.EventAttributes[s.keyAttribute]; !isUnset(key) {
+			msg.Key = []byte(key)
+		}
+	}
+
+	if s.format == "json" {
+		msg.Value = r.RecordToJSON()
+	} else {
+		msg.Value = r.RecordToCSV()
+	}
+
+	s.dataChan <- kafkaRecord{msg, r.Ack}
+	return nil
+}
+
+func (s *KafkaStream) Close() {
+	s.wg.Wait()
+	if err := s.writer.Close(); err != nil {
+		log.Errorf("error closing kafka writer: %s", err.Error())
+	}
+}
+
+func (s *KafkaStream) intervalStreamer() {
+
+	msgs := []kafka.Message{}
+	acks := []func(){}
+	sizeAccumulator := 0
+	timer := time.NewTicker(s.batchInterval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case data := <-s.dataChan:
+			msgs = append(msgs, data.msg)
+			acks = append(acks, data.ack)
+			sizeAccumulator += len(data.msg.Key) + len(data.msg.Value)
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(msgs) >= s.batchSize || sizeAccumulator >= s.batchBytes || flush) && len(msgs) > 0 {
+			s.writeMessages(msgs, acks, 0)
+			msgs = []kafka.Message{}
+			acks = []func(){}
+			sizeAccumulator = 0
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+func (s *KafkaStream) writeMessages(msgs []kafka.Message, acks []func(), failCount int) {
+	s.wg.Add(1)
+	go s._writeMessages(msgs, acks, failCount)
+}
+
+func (s *KafkaStream) _writeMessages(msgs []kafka.Message, acks []func(), failCount int) {
+
+	defer s.wg.Done()
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v kafka messages in %v seconds", len(msgs), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	// not s.ctx, the last batches are written after it's cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), KAFKA_WRITE_TIMEOUT)
+	defer cancel()
+
+	err := s.writer.WriteMessages(ctx, msgs...)
+	if err == nil {
+		for _, ack := range acks {
+			ack()
+		}
+		if failCount > 0 {
+			log.Warnf("%v kafka messages succeeded after %v retries", len(msgs), failCount)
+		}
+		return
+	}
+
+	if failCount >= s.maxRetry {
+		dropRecords(acks, "retry count exceeded %v for kafka messages: %s", s.maxRetry, err.Error())
+		return
+	}
+
+	writeErrors, ok := err.(kafka.WriteErrors)
+	if !ok {
+		log.Errorf("error writing to kafka: %s", err.Error())
+		s.writeMessages(msgs, acks, failCount+1)
+		return
+	}
+
+	// retry the messages that failed and ack the rest
+	newMsgs := []kafka.Message{}
+	newAcks := []func(){}
+	for i, msgErr := range writeErrors {
+		if msgErr != nil {
+			newMsgs = append(newMsgs, msgs[i])
+			newAcks = append(newAcks, acks[i])
+		} else {
+			acks[i]()
+		}
+	}
+
+	log.Errorf("error writing %d of %d kafka messages: %s", len(newMsgs), len(msgs), err.Error())
+	s.writeMessages(newMsgs, newAcks, failCount+1)
+}
+
+func (s *KafkaStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseKafkaOptions(opts map[string]string) *KafkaStream {
+
+	s := &KafkaStream{
+		writer:        &kafka.Writer{RequiredAcks: kafka.RequireAll},
+		format:        "csv",
+		batchSize:     KAFKA_BATCH_SIZE_DEFAULT,
+		batchBytes:    KAFKA_BATCH_BYTES_DEFAULT,
+		batchInterval: KAFKA_BATCH_INTERVAL_DEFAULT,
+		maxRetry:      KAFKA_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "brokers":
+			s.brokers = omitEmpty(strings.Split(strings.Replace(val, " ", "", -1), ","))
+		case "topic":
+			s.topic = val
+		case "topic_attribute":
+			s.topicAttribute = val
+		case "key_attribute":
+			s.keyAttribute = val
+		case "format":
+			if val != "csv" && val != "json" {
+				log.Fatalf("kafka format %s not supported", val)
+			}
+			s.format = val
+		case "batch_size":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchSize = i
+		case "batch_bytes":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchBytes = i
+		case "batch_interval_ms":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchInterval = time.Duration(i) * time.Millisecond
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		case "acks":
+			if err := s.writer.RequiredAcks.UnmarshalText([]byte(val)); err != nil {
+				log.Fatal(err.Error())
+			}
+		case "compression":
+			switch strings.ToLower(val) {
+			case "none", "":
+				s.writer.Compression = 0
+			case "gzip":
+				s.writer.Compression = kafka.Gzip
+			case "snappy":
+				s.writer.Compression = kafka.Snappy
+			case "lz4":
+				s.writer.Compression = kafka.Lz4
+			case "zstd":
+				s.writer.Compression = kafka.Zstd
+			default:
+				log.Fatalf("kafka compression %s not supported", val)
+			}
+		default:
+			break
+		}
+	}
+
+	return s
+}
+
+func parseSASLOptions(opts map[string]string) sasl.Mechanism {
+
+	username, password := opts["sasl_username"], opts["sasl_password"]
+
+	switch strings.ToLower(opts["sasl_mechanism"]) {
+	case "":
+		return nil
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}
+	case "scram-sha-256", "scram-sha-512":
+		algo := scram.SHA256
+		if strings.HasSuffix(opts["sasl_mechanism"], "512") {
+			algo = scram.SHA512
+		}
+		mechanism, err := scram.Mechanism(algo, username, password)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return mechanism
+	default:
+		log.Fatalf("sasl mechanism %s not supported", opts["sasl_mechanism"])
+	}
+
+	return nil
+}
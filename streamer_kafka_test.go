@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaStreamMessage(t *testing.T) {
+
+	s := parseKafkaOptions(ParseOptions([]string{
+		"brokers: localhost:9092, localhost:9093",
+		"topic_attribute: app",
+		"key_attribute: log_line",
+		"format: json",
+		"acks: one",
+		"compression: gzip",
+	}))
+	s.topic = "default-topic"
+	s.dataChan = make(chan kafkaRecord, 2)
+	s.recordFormat = testFormat
+
+	if len(s.brokers) != 2 || s.writer.RequiredAcks != kafka.RequireOne || s.writer.Compression != kafka.Gzip {
+		t.Fatalf("options not parsed: %+v", s)
+	}
+
+	s.Stream(NewRecord("", testFormat, map[string]string{"app": "web", "response_bytes": "42", "log_line": "GET /"}))
+	s.Stream(NewRecord("", testFormat, map[string]string{"app": "", "response_bytes": "-", "log_line": "\\N"}))
+
+	first := <-s.dataChan
+	if first.msg.Topic != "web" || string(first.msg.Key) != "GET /" {
+		t.Fatalf("unexpected topic %s or key %s", first.msg.Topic, first.msg.Key)
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(first.msg.Value, &doc); err != nil {
+		t.Fatal(err.Error())
+	}
+	if doc["response_bytes"] != float64(42) {
+		t.Fatalf("expected a typed response_bytes, got %v", doc["response_bytes"])
+	}
+
+	if second := <-s.dataChan; second.msg.Topic != "default-topic" || second.msg.Key != nil {
+		t.Fatalf("expected the default topic and no key for nulls, got %s and %q", second.msg.Topic, second.msg.Key)
+	}
+}
+
+// Runs against a local broker, for example:
+//
+//	docker run -d -p 9092:9092 apache/kafka:3.7.0
+//	PUSHR_KAFKA_BROKERS=localhost:9092 go test -run TestKafkaStreamBroker
+func TestKafkaStreamBroker(t *testing.T) {
+
+	brokers := os.Getenv("PUSHR_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("PUSHR_KAFKA_BROKERS not set")
+	}
+
+	topic := fmt.Sprintf("pushr-test-%d", time.Now().UnixNano())
+	conn, err := kafka.Dial("tcp", strings.Split(brokers, ",")[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = conn.CreateTopics(kafka.TopicConfig{Topic: topic, NumPartitions: 1, ReplicationFactor: 1})
+	conn.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewKafkaStream(ctx, testFormat, topic, []string{"brokers: " + brokers, "batch_interval_ms: 100"})
+
+	acked := make(chan bool, 10)
+	records := []*Record{}
+	for i := 0; i < 10; i++ {
+		r := NewRecord("", testFormat, map[string]string{"app": "web", "response_bytes": fmt.Sprint(i), "log_line": "GET /"})
+		r.SetAck(func() { acked <- true })
+		records = append(records, r)
+		s.Stream(r)
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second * 30):
+			t.Fatalf("only %d of 10 messages acked", i)
+		}
+	}
+	cancel()
+	s.Close()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: strings.Split(brokers, ","), Topic: topic})
+	defer reader.Close()
+	readCtx, readCancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer readCancel()
+	msg, err := reader.ReadMessage(readCtx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(msg.Value) != string(records[0].RecordToCSV()) {
+		t.Fatalf("unexpected message %q", msg.Value)
+	}
+}
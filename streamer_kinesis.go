@@ -0,0 +1,404 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"math"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	KINESIS_BATCH_LIMIT              = 500
+	KINESIS_REQUEST_SIZE_LIMIT       = 5 << 20 // 5MB
+	KINESIS_RECORD_SIZE_LIMIT        = 1 << 20 // 1MB
+	KINESIS_PARTITION_KEY_LIMIT      = 256
+	KINESIS_SHARD_RECORDS_PER_SECOND = 1000
+	KINESIS_SHARD_BYTES_PER_SECOND   = 1 << 20 // 1MB
+	KINESIS_SHARD_REFRESH            = time.Minute * 5
+	KINESIS_MAX_RETRY_DEFAULT        = 5
+)
+
+type KinesisStream struct {
+	ctx                   context.Context
+	wg                    sync.WaitGroup
+	svc                   *kinesis.Kinesis
+	stream                string
+	endpoint              string
+	partitionKeyAttribute string
+	format                string
+	interval              time.Duration
+	maxRetry              int
+	shardRecords          int // per second
+	shardBytes            int // per second
+	shards                []*kinesisShard
+	shardsUpdated         time.Time
+	dataChan              chan kinesisRecord
+	recordFormat          []Attribute
+}
+
+type kinesisRecord struct {
+	entry *kinesis.PutRecordsRequestEntry
+	ack   func()
+}
+
+func (r kinesisRecord) size() int {
+	return len(r.entry.Data) + len(aws.StringValue(r.entry.PartitionKey))
+}
+
+// kinesisShard keeps track of what was sent to a shard during the current
+// second, so batches stay under the shard's write limits instead of
+// bouncing off them.
+type kinesisShard struct {
+	id      string
+	start   *big.Int
+	end     *big.Int
+	window  time.Time
+	records int
+	bytes   int
+}
+
+func NewKinesisStream(ctx context.Context, recordFormat []Attribute, accessKey, secretAccessKey, awsRegion, awsSTSRole, streamName string, options []string) *KinesisStream {
+
+	if awsRegion == "" {
+		log.Fatal("Please Specify the region your kinesis stream is.")
+	}
+
+	s := parseKinesisOptions(ParseOptions(options))
+	sess, awsConfig := newAWSSession(accessKey, secretAccessKey, awsRegion, awsSTSRole, s.endpoint)
+
+	s.ctx = ctx
+	s.svc = kinesis.New(sess, awsConfig)
+	s.stream = streamName
+	s.dataChan = make(chan kinesisRecord, KINESIS_BATCH_LIMIT*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *KinesisStream) Stream(r *Record) error {
+
+	var data []byte
+	if s.format == "json" {
+		data = r.RecordToJSON()
+	} else {
+		data = r.RecordToCSV()
+	}
+
+	key := ""
+	if s.partitionKeyAttribute != "" {
+		key = r.EventAttributes[s.partitionKeyAttribute]
+	}
+	if isUnset(key) {
+		key, _ = GenerateUUID()
+	}
+
+	s.dataChan <- kinesisRecord{
+		entry: &kinesis.PutRecordsRequestEntry{
+			Data:         data,
+			PartitionKey: aws.String(ConvertToUTF8(key, KINESIS_PARTITION_KEY_LIMIT)),
+		},
+		ack: r.Ack,
+	}
+	return nil
+}
+
+func (s *KinesisStream) Close() {
+	s.wg.Wait()
+}
+
+func (s *KinesisStream) intervalStreamer() {
+
+	pending := []kinesisRecord{}
+	pendingSize := 0
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		// while shards are throttled stop taking records so Stream() pushes back
+		dataChan := s.dataChan
+		if len(pending) >= KINESIS_BATCH_LIMIT*10 {
+			dataChan = nil
+		}
+
+		flush := false
+		select {
+		case data := <-dataChan:
+			if data.size() > KINESIS_RECORD_SIZE_LIMIT {
+				// kinesis will never take it, don't hold the checkpoint back
+				dropRecords([]func(){data.ack}, "kinesis record over 1MB: %s", truncateString(string(data.entry.Data), 512))
+				continue
+			}
+			pending = append(pending, data)
+			pendingSize += data.size()
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if len(pending) >= KINESIS_BATCH_LIMIT || pendingSize >= KINESIS_REQUEST_SIZE_LIMIT || flush {
+			pending = s.sendBatches(pending, exit)
+			pendingSize = 0
+			for _, r := range pending {
+				pendingSize += r.size()
+			}
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+// sendBatches sends what the shards can take this second and returns the
+// records that have to wait. Once a shard is full, later records for it
+// wait too so they stay in order. force sends everything.
+func (s *KinesisStream) sendBatches(pending []kinesisRecord, force bool) []kinesisRecord {
+
+	if time.Since(s.shardsUpdated) > KINESIS_SHARD_REFRESH {
+		s.refreshShards()
+	}
+
+	now := time.Now().Truncate(time.Second)
+	held := []kinesisRecord{}
+	full := map[*kinesisShard]bool{}
+
+	batch := []*kinesis.PutRecordsRequestEntry{}
+	acks := []func(){}
+	batchSize := 0
+
+	for _, r := range pending {
+
+		size := r.size()
+
+		if shard := s.shardFor(aws.StringValue(r.entry.PartitionKey)); shard != nil && !force {
+			if !shard.window.Equal(now) {
+				shard.window, shard.records, shard.bytes = now, 0, 0
+			}
+			if full[shard] || (shard.records > 0 && (shard.records+1 > s.shardRecords || shard.bytes+size > s.shardBytes)) {
+				full[shard] = true
+				held = append(held, r)
+				continue
+			}
+			shard.records += 1
+			shard.bytes += size
+		}
+
+		if len(batch) == KINESIS_BATCH_LIMIT || batchSize+size > KINESIS_REQUEST_SIZE_LIMIT {
+			s.putRecords(batch, acks, 0)
+			batch = []*kinesis.PutRecordsRequestEntry{}
+			acks = []func(){}
+			batchSize = 0
+		}
+
+		batch = append(batch, r.entry)
+		acks = append(acks, r.ack)
+		batchSize += size
+	}
+
+	if len(batch) > 0 {
+		s.putRecords(batch, acks, 0)
+	}
+
+	if len(held) > 0 {
+		log.Debugf("%d kinesis records waiting on throttled shards", len(held))
+	}
+
+	return held
+}
+
+// shardFor returns the open shard a partition key maps to, nil when the
+// shards are unknown.
+func (s *KinesisStream) shardFor(key string) *kinesisShard {
+
+	if len(s.shards) == 0 {
+		return nil
+	}
+
+	sum := md5.Sum([]byte(key))
+	hashKey := new(big.Int).SetBytes(sum[:])
+	for _, shard := range s.shards {
+		if hashKey.Cmp(shard.start) >= 0 && hashKey.Cmp(shard.end) <= 0 {
+			return shard
+		}
+	}
+
+	return nil
+}
+
+func (s *KinesisStream) refreshShards() {
+
+	s.shardsUpdated = time.Now()
+	shards := []*kinesisShard{}
+
+	params := &kinesis.DescribeStreamInput{StreamName: aws.String(s.stream)}
+	for {
+		out, err := s.svc.DescribeStream(params)
+		if err != nil {
+			// without the shard map records are only batched by request limits
+			log.Warnf("unable to describe kinesis stream %s: %s", s.stream, err.Error())
+			s.shards = nil
+			return
+		}
+
+		for _, shard := range out.StreamDescription.Shards {
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				// closed after a split or merge
+				continue
+			}
+			start, ok1 := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.StartingHashKey), 10)
+			end, ok2 := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.EndingHashKey), 10)
+			if !ok1 || !ok2 {
+				continue
+			}
+			shards = append(shards, &kinesisShard{id: aws.StringValue(shard.ShardId), start: start, end: end})
+		}
+
+		if !aws.BoolValue(out.StreamDescription.HasMoreShards) || len(out.StreamDescription.Shards) == 0 {
+			break
+		}
+		params.ExclusiveStartShardId = out.StreamDescription.Shards[len(out.StreamDescription.Shards)-1].ShardId
+	}
+
+	s.shards = shards
+}
+
+func (s *KinesisStream) putRecords(data []*kinesis.PutRecordsRequestEntry, acks []func(), failCount int) {
+	s.wg.Add(1)
+	go s._putRecords(data, acks, failCount)
+}
+
+func (s *KinesisStream) _putRecords(data []*kinesis.PutRecordsRequestEntry, acks []func(), failCount int) {
+
+	defer s.wg.Done()
+
+	if failCount > s.maxRetry {
+		dropRecords(acks, "retry count exceeded %v for kinesis records", s.maxRetry)
+		return
+	}
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v kinesis records in %v seconds", len(data), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	params := &kinesis.PutRecordsInput{
+		StreamName: aws.String(s.stream),
+		Records:    data,
+	}
+
+	r, err := s.svc.PutRecords(params)
+	if err != nil {
+		log.Error(err.Error())
+		s.putRecords(data, acks, failCount+1)
+		return
+	}
+
+	if aws.Int64Value(r.FailedRecordCount) > 0 {
+
+		// retry the records that failed and ack the rest
+		newData := []*kinesis.PutRecordsRequestEntry{}
+		newAcks := []func(){}
+		for i, res := range r.Records {
+			if res.ErrorCode != nil {
+				newData = append(newData, data[i])
+				newAcks = append(newAcks, acks[i])
+			} else {
+				acks[i]()
+			}
+		}
+
+		log.Warnf("%d of %d kinesis records failed: %s", len(newData), len(data), aws.StringValue(r.Records[0].ErrorCode))
+		s.putRecords(newData, newAcks, failCount+1)
+		return
+	}
+
+	for _, ack := range acks {
+		ack()
+	}
+
+	if failCount > 0 {
+		log.Warnf("%v kinesis records succeeded after %v retries", len(data), failCount)
+	}
+}
+
+func (s *KinesisStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseKinesisOptions(opts map[string]string) *KinesisStream {
+
+	s := &KinesisStream{
+		format:       "csv",
+		interval:     time.Second,
+		maxRetry:     KINESIS_MAX_RETRY_DEFAULT,
+		shardRecords: KINESIS_SHARD_RECORDS_PER_SECOND,
+		shardBytes:   KINESIS_SHARD_BYTES_PER_SECOND,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "partition_key_attribute":
+			s.partitionKeyAttribute = val
+		case "endpoint":
+			s.endpoint = val
+		case "format":
+			if val != "csv" && val != "json" {
+				log.Fatalf("kinesis format %s not supported", val)
+			}
+			s.format = val
+		case "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		case "shard_records_per_second":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.shardRecords = i
+		case "shard_bytes_per_second":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.shardBytes = i
+		default:
+			break
+		}
+	}
+
+	return s
+}
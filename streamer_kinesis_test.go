@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestKinesisPartitionKeyShard(t *testing.T) {
+
+	s := parseKinesisOptions(ParseOptions([]string{"partition_key_attribute: device_tag"}))
+	s.dataChan = make(chan kinesisRecord, 2)
+	s.recordFormat = testFormat
+
+	s.Stream(NewRecord("", testFormat, map[string]string{"device_tag": "device-1"}))
+	s.Stream(NewRecord("", testFormat, map[string]string{"device_tag": ""}))
+
+	if key := aws.StringValue((<-s.dataChan).entry.PartitionKey); key != "device-1" {
+		t.Fatalf("expected the device_tag as partition key, got %s", key)
+	}
+	if key := aws.StringValue((<-s.dataChan).entry.PartitionKey); key == "" {
+		t.Fatal("expected a random partition key without a device_tag")
+	}
+
+	// md5("device-1") starts with 0xd1, the upper half of the hash key space
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+	half := new(big.Int).Rsh(max, 1)
+	s.shards = []*kinesisShard{
+		{id: "shardId-000000000000", start: big.NewInt(0), end: half},
+		{id: "shardId-000000000001", start: new(big.Int).Add(half, big.NewInt(1)), end: max},
+	}
+
+	if shard := s.shardFor("device-1"); shard == nil || shard.id != "shardId-000000000001" {
+		t.Fatalf("device-1 mapped to the wrong shard: %+v", shard)
+	}
+}
@@ -0,0 +1,440 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/golang/snappy"
+)
+
+const (
+	LOKI_PUSH_PATH          = "/loki/api/v1/push"
+	LOKI_BATCH_SIZE_DEFAULT = 1000
+	LOKI_BATCH_BYTES        = 1 << 20 // 1MB
+	LOKI_MAX_RETRY_DEFAULT  = 5
+	LOKI_REQUEST_TIMEOUT    = time.Second * 30
+)
+
+var lokiLabelsDefault = []string{"app", "hostname", "filename", "log_level"}
+
+// LokiStream pushes log_line to Loki, grouped into Loki streams by the
+// values of the label attributes.
+type LokiStream struct {
+	ctx          context.Context
+	wg           sync.WaitGroup
+	client       *http.Client
+	url          string
+	labels       []string
+	encoding     string
+	tenantID     string
+	username     string
+	password     string
+	batchSize    int
+	interval     time.Duration
+	maxRetry     int
+	dataChan     chan lokiEntry
+	recordFormat []Attribute
+}
+
+type lokiEntry struct {
+	labels map[string]string
+	ts     time.Time
+	line   string
+	ack    func()
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+// lokiBatch is what goes out in a single push request.
+type lokiBatch struct {
+	streams map[string]*lokiStream
+	acks    []func()
+	size    int
+}
+
+func newLokiBatch() *lokiBatch {
+	return &lokiBatch{streams: map[string]*lokiStream{}}
+}
+
+func (b *lokiBatch) add(e lokiEntry) {
+	key := lokiLabelString(e.labels)
+	stream, ok := b.streams[key]
+	if !ok {
+		stream = &lokiStream{labels: e.labels}
+		b.streams[key] = stream
+	}
+	stream.entries = append(stream.entries, e)
+	b.acks = append(b.acks, e.ack)
+	b.size += len(e.line)
+}
+
+func NewLokiStream(ctx context.Context, recordFormat []Attribute, url, streamName string, options []string) *LokiStream {
+
+	opts := ParseOptions(options)
+	s := parseLokiOptions(opts)
+
+	if s.url == "" {
+		s.url = url
+	}
+	if s.url == "" {
+		log.Fatalf("loki stream %s needs a url", streamName)
+	}
+	if !strings.HasSuffix(s.url, LOKI_PUSH_PATH) {
+		s.url = strings.TrimRight(s.url, "/") + LOKI_PUSH_PATH
+	}
+
+	s.ctx = ctx
+	s.client = &http.Client{
+		Timeout: LOKI_REQUEST_TIMEOUT,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: parseTLSOptions(opts),
+		},
+	}
+	s.dataChan = make(chan lokiEntry, s.batchSize*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *LokiStream) Stream(r *Record) error {
+
+	labels := map[string]string{}
+	for _, key := range s.labels {
+		if val := r.EventAttributes[key]; !isUnset(val) {
+			labels[key] = val
+		}
+	}
+
+	ts := time.Now()
+	if t, err := time.Parse(ISO_8601, r.EventAttributes["event_datetime"]); err == nil {
+		ts = t
+	}
+
+	line := r.EventAttributes["log_line"]
+	if line == "" {
+		line = r.rawLine
+	}
+
+	s.dataChan <- lokiEntry{labels, ts, line, r.Ack}
+	return nil
+}
+
+func (s *LokiStream) Close() {
+	s.wg.Wait()
+}
+
+func (s *LokiStream) intervalStreamer() {
+
+	batch := newLokiBatch()
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case e := <-s.dataChan:
+			batch.add(e)
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(batch.acks) >= s.batchSize || batch.size >= LOKI_BATCH_BYTES || flush) && len(batch.acks) > 0 {
+			s.push(batch, 0)
+			batch = newLokiBatch()
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+func (s *LokiStream) push(batch *lokiBatch, failCount int) {
+	s.wg.Add(1)
+	go s._push(batch, failCount, 0)
+}
+
+func (s *LokiStream) retry(batch *lokiBatch, failCount int, wait time.Duration) {
+	s.wg.Add(1)
+	go s._push(batch, failCount, wait)
+}
+
+func (s *LokiStream) _push(batch *lokiBatch, failCount int, wait time.Duration) {
+
+	defer s.wg.Done()
+
+	if failCount > s.maxRetry {
+		dropRecords(batch.acks, "retry count exceeded %v for loki entries", s.maxRetry)
+		return
+	}
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if wait > 0 {
+		sleepTime = wait
+	}
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v loki entries in %v", len(batch.acks), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	var body []byte
+	contentType := "application/x-protobuf"
+	if s.encoding == "json" {
+		body = encodeLokiJSON(batch)
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeLokiProtobuf(batch))
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		dropRecords(batch.acks, "unable to create loki request: %s", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenantID)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Errorf("error pushing to loki: %s", err.Error())
+		s.retry(batch, failCount+1, 0)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	msg := strings.TrimSpace(truncateString(string(respBody), 512))
+
+	switch {
+	case resp.StatusCode < 300:
+		if failCount > 0 {
+			log.Warnf("%v loki entries succeeded after %v retries", len(batch.acks), failCount)
+		}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// rate limited, wait as long as loki asks to
+		wait := time.Duration(0)
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+		log.Warnf("loki rate limited %d entries: %s", len(batch.acks), msg)
+		s.retry(batch, failCount+1, wait)
+		return
+	case resp.StatusCode >= 500:
+		log.Errorf("loki push failed with %d: %s", resp.StatusCode, msg)
+		s.retry(batch, failCount+1, 0)
+		return
+	case isLokiOutOfOrder(msg):
+		// the entries that were in order are stored, resending only
+		// produces the same error for the rest
+		log.Warnf("loki rejected out of order entries: %s", msg)
+	default:
+		dropRecords(batch.acks, "loki rejected them with %d: %s", resp.StatusCode, msg)
+		return
+	}
+
+	for _, ack := range batch.acks {
+		ack()
+	}
+}
+
+func isLokiOutOfOrder(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "out of order") || strings.Contains(msg, "too far behind") || strings.Contains(msg, "too old")
+}
+
+// lokiLabelString formats labels the way loki expects them, {a="1", b="2"}
+func lokiLabelString(labels map[string]string) string {
+
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+strconv.Quote(labels[key]))
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// sortedStreams returns the streams of the batch with their entries in
+// time order, older lokis refuse anything else.
+func (b *lokiBatch) sortedStreams() []*lokiStream {
+
+	keys := []string{}
+	for key := range b.streams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	streams := []*lokiStream{}
+	for _, key := range keys {
+		stream := b.streams[key]
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].ts.Before(stream.entries[j].ts)
+		})
+		streams = append(streams, stream)
+	}
+
+	return streams
+}
+
+func encodeLokiJSON(batch *lokiBatch) []byte {
+
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	streams := []jsonStream{}
+	for _, stream := range batch.sortedStreams() {
+		values := [][2]string{}
+		for _, e := range stream.entries {
+			values = append(values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		streams = append(streams, jsonStream{stream.labels, values})
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"streams": streams})
+	return data
+}
+
+// encodeLokiProtobuf encodes a logproto.PushRequest:
+//
+//	PushRequest  { repeated Stream streams = 1; }
+//	Stream       { string labels = 1; repeated Entry entries = 2; }
+//	Entry        { Timestamp timestamp = 1; string line = 2; }
+//	Timestamp    { int64 seconds = 1; int32 nanos = 2; }
+func encodeLokiProtobuf(batch *lokiBatch) []byte {
+
+	req := []byte{}
+	for _, stream := range batch.sortedStreams() {
+
+		msg := protoBytes(nil, 1, []byte(lokiLabelString(stream.labels)))
+		for _, e := range stream.entries {
+			ts := protoVarint(nil, 1, uint64(e.ts.Unix()))
+			ts = protoVarint(ts, 2, uint64(e.ts.Nanosecond()))
+			entry := protoBytes(nil, 1, ts)
+			entry = protoBytes(entry, 2, []byte(e.line))
+			msg = protoBytes(msg, 2, entry)
+		}
+
+		req = protoBytes(req, 1, msg)
+	}
+
+	return req
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, v)
+	return append(buf, tmp[:n]...)
+}
+
+func protoVarint(buf []byte, field int, v uint64) []byte {
+	buf = appendUvarint(buf, uint64(field<<3))
+	return appendUvarint(buf, v)
+}
+
+func protoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func (s *LokiStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseLokiOptions(opts map[string]string) *LokiStream {
+
+	s := &LokiStream{
+		labels:    lokiLabelsDefault,
+		encoding:  "protobuf",
+		batchSize: LOKI_BATCH_SIZE_DEFAULT,
+		interval:  time.Second,
+		maxRetry:  LOKI_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "url":
+			s.url = val
+		case "labels":
+			s.labels = omitEmpty(strings.Split(strings.Replace(val, " ", "", -1), ","))
+		case "encoding":
+			if val != "protobuf" && val != "json" {
+				log.Fatalf("loki encoding %s not supported", val)
+			}
+			s.encoding = val
+		case "tenant_id":
+			s.tenantID = val
+		case "username":
+			s.username = val
+		case "password":
+			s.password = val
+		case "batch_size":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchSize = i
+		case "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		default:
+			break
+		}
+	}
+
+	return s
+}
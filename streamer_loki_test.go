@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestLokiPush(t *testing.T) {
+
+	var mu sync.Mutex
+	requests := 0
+	bodies := [][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests += 1
+		if r.URL.Path != LOKI_PUSH_PATH || r.Header.Get("X-Scope-OrgID") != "tenant" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewLokiStream(ctx, testFormat, server.URL, "test", []string{
+		"labels: app, log_level",
+		"encoding: json",
+		"tenant_id: tenant",
+	})
+
+	acked := make(chan bool, 3)
+	lines := []map[string]string{
+		{"event_datetime": "2017-01-01T00:00:02Z", "app": "web", "log_level": "info", "log_line": "second"},
+		{"event_datetime": "2017-01-01T00:00:01Z", "app": "web", "log_level": "info", "log_line": "first"},
+		{"event_datetime": "2017-01-01T00:00:01Z", "app": "web", "log_level": "\\N", "log_line": "no level"},
+	}
+	for _, line := range lines {
+		r := NewRecord("", testFormat, line)
+		r.SetAck(func() { acked <- true })
+		s.Stream(r)
+	}
+	for i := 0; i < len(lines); i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second * 10):
+			t.Fatalf("only %d of %d entries acked", i, len(lines))
+		}
+	}
+	cancel()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 || len(bodies) != 1 {
+		t.Fatalf("expected a retry after the 429, got %d requests", requests)
+	}
+
+	push := struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}{}
+	if err := json.Unmarshal(bodies[0], &push); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %s", bodies[0])
+	}
+	for _, stream := range push.Streams {
+		if _, ok := stream.Stream["log_level"]; !ok {
+			continue
+		}
+		if len(stream.Values) != 2 || stream.Values[0][1] != "first" || stream.Values[0][0] != "1483228801000000000" {
+			t.Fatalf("expected entries in time order, got %v", stream.Values)
+		}
+	}
+}
+
+func TestLokiProtobuf(t *testing.T) {
+
+	batch := newLokiBatch()
+	batch.add(lokiEntry{map[string]string{"app": "web", "hostname": "a\"b"}, time.Unix(1, 5), "hello", func() {}})
+
+	got := encodeLokiProtobuf(batch)
+	want := []byte{0x0a, 0x2d, // streams
+		0x0a, 0x1c}
+	want = append(want, []byte(`{app="web", hostname="a\"b"}`)...)
+	want = append(want, 0x12, 0x0d, // entries
+		0x0a, 0x04, 0x08, 0x01, 0x10, 0x05, // timestamp
+		0x12, 0x05)
+	want = append(want, []byte("hello")...)
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected encoding\n got %x\nwant %x", got, want)
+	}
+
+	if decoded, err := snappy.Decode(nil, snappy.Encode(nil, got)); err != nil || !bytes.Equal(decoded, got) {
+		t.Fatal("snappy round trip failed")
+	}
+}
+
+func TestLokiOutOfOrder(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry out of order for stream", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewLokiStream(ctx, testFormat, server.URL, "test", []string{"max_retry: 0"})
+
+	acked := make(chan bool, 1)
+	r := NewRecord("", testFormat, map[string]string{"app": "web", "log_line": "late"})
+	r.SetAck(func() { acked <- true })
+	s.Stream(r)
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second * 10):
+		t.Fatal("out of order entry was not acked")
+	}
+	cancel()
+	s.Close()
+}
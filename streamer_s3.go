@@ -23,9 +23,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -41,7 +38,8 @@ type S3Stream struct {
 	svc            *s3.S3
 	bucket         string
 	prefix         string
-	dataChan       chan []byte
+	dataChan       chan encodedRecord
+	acks           []func()
 	recordFormat   []Attribute
 	apiUrl         string
 	apiKey         string
@@ -50,10 +48,14 @@ type S3Stream struct {
 	ddlVersion     string
 	s3Owner        string
 	compression    string
+	spool          *Spool
 }
 
 func (s *S3Stream) Close() {
 	s.wg.Wait()
+	if s.spool != nil {
+		s.spool.Close()
+	}
 }
 
 func NewS3Stream(ctx context.Context, recordFormat []Attribute, accessKey, secretAccessKey,
@@ -62,31 +64,14 @@ func NewS3Stream(ctx context.Context, recordFormat []Attribute, accessKey, secre
 	opts := ParseOptions(options)
 	s := parseS3Options(opts)
 
-	sess := &session.Session{}
-	awsConfig := &aws.Config{Region: aws.String(awsRegion)}
-
-	if awsSTSRole != "" {
-		sess = session.Must(session.NewSession())
-		creds := stscreds.NewCredentials(sess, awsSTSRole)
-		awsConfig.Credentials = creds
-	} else if accessKey == "" || secretAccessKey == "" {
-		// try IAM
-		sess = session.New(nil)
-	} else {
-		creds := credentials.NewStaticCredentials(accessKey, secretAccessKey, "")
-		config := &aws.Config{
-			Region:      aws.String(awsRegion),
-			Credentials: creds,
-		}
-		sess = session.New(config)
-	}
+	sess, awsConfig := newAWSSession(accessKey, secretAccessKey, awsRegion, awsSTSRole, "")
 
 	s.ctx = ctx
 	s.svc = s3.New(sess, awsConfig)
 	s.stream = streamName
 	s.buf = bytes.Buffer{}
 	s.mutex = new(sync.RWMutex)
-	s.dataChan = make(chan []byte, s.bufferSize*2)
+	s.dataChan = make(chan encodedRecord, s.bufferSize*2)
 	s.recordFormat = recordFormat
 
 	const maxUploadRetryDefault = 3
@@ -95,6 +80,11 @@ func NewS3Stream(ctx context.Context, recordFormat []Attribute, accessKey, secre
 		s.maxUploadRetry = maxUploadRetryDefault
 	}
 
+	s.spool = newSpoolFromOptions(ctx, streamName, opts)
+	if s.spool != nil {
+		go s.spool.Pump(s.dataChan)
+	}
+
 	s.wg.Add(1)
 	go s.IntervalStreamer()
 
@@ -103,7 +93,10 @@ func NewS3Stream(ctx context.Context, recordFormat []Attribute, accessKey, secre
 }
 
 func (s *S3Stream) Stream(r *Record) error {
-	s.dataChan <- r.RecordToCSV()
+	if s.spool != nil {
+		return s.spool.Write(r.RecordToCSV(), r.Ack)
+	}
+	s.dataChan <- encodedRecord{r.RecordToCSV(), r.Ack}
 	return nil
 }
 
@@ -114,7 +107,7 @@ func (s *S3Stream) IntervalStreamer() {
 	for {
 		select {
 		case data := <-s.dataChan:
-			s.writeData(data, false)
+			s.writeData(&data, false)
 		case <-timer.C:
 			s.writeData(nil, true)
 		case <-s.ctx.Done():
@@ -131,13 +124,14 @@ func (s *S3Stream) IntervalStreamer() {
 	}
 }
 
-func (s *S3Stream) writeData(data []byte, forceUpload bool) {
+func (s *S3Stream) writeData(data *encodedRecord, forceUpload bool) {
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if data != nil {
-		s.buf.Write(data)
+		s.buf.Write(data.data)
+		s.acks = append(s.acks, data.ack)
 		s.recordCount += 1
 	}
 
@@ -155,21 +149,28 @@ func (s *S3Stream) writeData(data []byte, forceUpload bool) {
 			copy(dataCopy, s.buf.Bytes())
 		}
 
-		s.uploadBuffer(dataCopy, s.recordCount, 0)
+		s.uploadBuffer(dataCopy, s.recordCount, s.acks, 0)
 		s.buf.Reset()
 		s.recordCount = 0
+		s.acks = nil
 	}
 }
 
-func (s *S3Stream) uploadBuffer(data []byte, recordCount, retryCount int) {
+func (s *S3Stream) uploadBuffer(data []byte, recordCount int, acks []func(), retryCount int) {
 	s.wg.Add(1)
-	go s._uploadBuffer(data, recordCount, retryCount)
+	go s._uploadBuffer(data, recordCount, acks, retryCount)
 }
 
-func (s *S3Stream) _uploadBuffer(data []byte, recordCount, retryCount int) {
+func (s *S3Stream) _uploadBuffer(data []byte, recordCount int, acks []func(), retryCount int) {
 
 	defer s.wg.Done()
 
+	if retryCount > 0 && s.spool != nil && s.ctx.Err() != nil {
+		// shutting down, the spool sends them again on the next run
+		log.Warnf("Leaving %v records in the spool", len(acks))
+		return
+	}
+
 	var sleepTime = time.Duration(math.Min(60.0, float64(5*retryCount))) * time.Second
 	if sleepTime > time.Duration(0) {
 		log.Warnf("Retrying buffer stream with %v records in %v seconds, retry count %v", len(data), sleepTime, retryCount)
@@ -202,12 +203,13 @@ func (s *S3Stream) _uploadBuffer(data []byte, recordCount, retryCount int) {
 	_, err := s.svc.PutObject(s3PutOpts)
 
 	if err != nil {
-		if retryCount >= s.maxUploadRetry {
-			log.Warnf("Retry count exceeded %v, dropping buffer stream of length %v", s.maxUploadRetry, len(data))
+		// spooled records are retried until they're delivered
+		if retryCount >= s.maxUploadRetry && s.spool == nil {
+			dropRecords(acks, "retry count exceeded %v for an s3 upload of %v bytes", s.maxUploadRetry, len(data))
 			return
 		}
 		log.Printf("Error uploading to S3: \n%v\nretrying...", err.Error())
-		s.uploadBuffer(data, recordCount, retryCount+1)
+		s.uploadBuffer(data, recordCount, acks, retryCount+1)
 		return
 	}
 
@@ -215,6 +217,10 @@ func (s *S3Stream) _uploadBuffer(data []byte, recordCount, retryCount int) {
 		log.Warnf("S3 copy succeeded after %v retries", retryCount)
 	}
 
+	for _, ack := range acks {
+		ack()
+	}
+
 	if s.apiUrl != "" {
 		opts := AddFileRequest{
 			Fullpath:    key,
@@ -0,0 +1,388 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	HEC_EVENT_PATH          = "/services/collector/event"
+	HEC_ACK_PATH            = "/services/collector/ack"
+	HEC_BATCH_SIZE_DEFAULT  = 500
+	HEC_BATCH_BYTES_DEFAULT = 1 << 20 // 1MB
+	HEC_MAX_RETRY_DEFAULT   = 5
+	HEC_ACK_POLL_DEFAULT    = time.Second * 5
+	HEC_ACK_TIMEOUT_DEFAULT = time.Minute * 5
+	HEC_REQUEST_TIMEOUT     = time.Second * 30
+	HEC_CODE_ACK_DISABLED   = 14
+)
+
+// SplunkStream posts events to a Splunk HTTP Event Collector. With use_ack
+// records are only acked once the indexers confirm the batch was indexed.
+type SplunkStream struct {
+	ctx          context.Context
+	wg           sync.WaitGroup
+	client       *http.Client
+	url          string // without the /services/collector paths
+	token        string
+	index        string
+	sourcetype   string
+	channel      string
+	useAck       bool
+	ackPoll      time.Duration
+	ackTimeout   time.Duration
+	batchSize    int
+	batchBytes   int
+	interval     time.Duration
+	maxRetry     int
+	dataChan     chan encodedRecord
+	recordFormat []Attribute
+}
+
+type hecEvent struct {
+	Time       float64           `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      string            `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId"`
+}
+
+func NewSplunkStream(ctx context.Context, recordFormat []Attribute, url, streamName string, options []string) *SplunkStream {
+
+	opts := ParseOptions(options)
+	s := parseSplunkOptions(opts)
+
+	if s.url == "" {
+		s.url = url
+	}
+	if s.url == "" {
+		log.Fatalf("splunk_hec stream %s needs a url", streamName)
+	}
+	if s.token == "" {
+		log.Fatalf("splunk_hec stream %s needs a token", streamName)
+	}
+	s.url = strings.TrimSuffix(strings.TrimRight(s.url, "/"), HEC_EVENT_PATH)
+
+	if s.channel == "" {
+		s.channel, _ = GenerateUUID()
+	}
+
+	s.ctx = ctx
+	s.client = &http.Client{
+		Timeout: HEC_REQUEST_TIMEOUT,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: parseTLSOptions(opts),
+		},
+	}
+	s.dataChan = make(chan encodedRecord, s.batchSize*2)
+	s.recordFormat = recordFormat
+
+	s.wg.Add(1)
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *SplunkStream) Stream(r *Record) error {
+
+	event := hecEvent{
+		Time:       float64(time.Now().UnixNano()/1e6) / 1000,
+		Host:       r.EventAttributes["hostname"],
+		Source:     r.EventAttributes["filename"],
+		Sourcetype: s.sourcetype,
+		Index:      s.index,
+		Event:      r.EventAttributes["log_line"],
+		Fields:     map[string]string{},
+	}
+
+	if t, err := time.Parse(ISO_8601, r.EventAttributes["event_datetime"]); err == nil {
+		event.Time = float64(t.UnixNano()/1e6) / 1000
+	}
+	if event.Sourcetype == "" {
+		event.Sourcetype = r.logfile
+	}
+	if event.Event == "" {
+		event.Event = r.rawLine
+	}
+
+	for key, val := range r.EventAttributes {
+		switch key {
+		case "log_line", "event_datetime", "hostname", "filename":
+			continue
+		}
+		if !isUnset(val) {
+			event.Fields[key] = val
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.dataChan <- encodedRecord{data, r.Ack}
+	return nil
+}
+
+func (s *SplunkStream) Close() {
+	s.wg.Wait()
+}
+
+func (s *SplunkStream) intervalStreamer() {
+
+	events := [][]byte{}
+	acks := []func(){}
+	sizeAccumulator := 0
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case data := <-s.dataChan:
+			events = append(events, data.data)
+			acks = append(acks, data.ack)
+			sizeAccumulator += len(data.data)
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(events) >= s.batchSize || sizeAccumulator >= s.batchBytes || flush) && len(events) > 0 {
+			s.post(bytes.Join(events, nil), acks, 0)
+			events = [][]byte{}
+			acks = []func(){}
+			sizeAccumulator = 0
+		}
+
+		if exit {
+			s.wg.Done()
+			s.wg.Wait()
+			break LOOP
+		}
+	}
+}
+
+func (s *SplunkStream) post(data []byte, acks []func(), failCount int) {
+	s.wg.Add(1)
+	go s._post(data, acks, failCount)
+}
+
+func (s *SplunkStream) _post(data []byte, acks []func(), failCount int) {
+
+	defer s.wg.Done()
+
+	if failCount > s.maxRetry {
+		dropRecords(acks, "retry count exceeded %v for splunk events", s.maxRetry)
+		return
+	}
+
+	var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+	if sleepTime > time.Duration(0) {
+		log.Warnf("Retrying %v splunk events in %v seconds", len(acks), sleepTime)
+	}
+	time.Sleep(sleepTime)
+
+	status, body, err := s.request(HEC_EVENT_PATH, data)
+	if err != nil {
+		log.Errorf("error posting to splunk: %s", err.Error())
+		s.post(data, acks, failCount+1)
+		return
+	}
+
+	resp := hecResponse{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		resp.Text = truncateString(string(body), 512)
+	}
+
+	switch {
+	case status < 300:
+	case status == http.StatusBadRequest:
+		// malformed events or an unknown index, resending won't change that
+		dropRecords(acks, "splunk rejected them: %s (code %d)", resp.Text, resp.Code)
+		return
+	default:
+		// bad token, busy indexers or full queues
+		log.Errorf("splunk post failed with %d: %s (code %d)", status, resp.Text, resp.Code)
+		s.post(data, acks, failCount+1)
+		return
+	}
+
+	if s.useAck && resp.AckId != nil && !s.waitForAck(*resp.AckId) {
+		log.Warnf("splunk ack %d for %d events not received in %v", *resp.AckId, len(acks), s.ackTimeout)
+		s.post(data, acks, failCount+1)
+		return
+	}
+
+	for _, ack := range acks {
+		ack()
+	}
+
+	if failCount > 0 {
+		log.Warnf("%v splunk events succeeded after %v retries", len(acks), failCount)
+	}
+}
+
+// waitForAck polls the collector until the batch with ackId is indexed. It
+// returns false when that doesn't happen within the ack timeout.
+func (s *SplunkStream) waitForAck(ackId int64) bool {
+
+	query, _ := json.Marshal(map[string][]int64{"acks": {ackId}})
+	deadline := time.Now().Add(s.ackTimeout)
+
+	for time.Now().Before(deadline) {
+
+		time.Sleep(s.ackPoll)
+
+		_, body, err := s.request(HEC_ACK_PATH, query)
+		if err != nil {
+			log.Warnf("error polling splunk acks: %s", err.Error())
+			continue
+		}
+
+		status := struct {
+			Code int             `json:"code"`
+			Acks map[string]bool `json:"acks"`
+		}{}
+		json.Unmarshal(body, &status)
+
+		if status.Code == HEC_CODE_ACK_DISABLED {
+			log.Warnf("indexer acknowledgement is disabled for this token, not waiting for acks")
+			return true
+		}
+		if status.Acks[strconv.FormatInt(ackId, 10)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SplunkStream) request(path string, data []byte) (int, []byte, error) {
+
+	req, err := http.NewRequest("POST", s.url+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("X-Splunk-Request-Channel", s.channel)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, body, err
+}
+
+func (s *SplunkStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseSplunkOptions(opts map[string]string) *SplunkStream {
+
+	s := &SplunkStream{
+		ackPoll:    HEC_ACK_POLL_DEFAULT,
+		ackTimeout: HEC_ACK_TIMEOUT_DEFAULT,
+		batchSize:  HEC_BATCH_SIZE_DEFAULT,
+		batchBytes: HEC_BATCH_BYTES_DEFAULT,
+		interval:   time.Second,
+		maxRetry:   HEC_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "url":
+			s.url = val
+		case "token":
+			s.token = val
+		case "index":
+			s.index = val
+		case "sourcetype":
+			s.sourcetype = val
+		case "channel":
+			s.channel = val
+		case "use_ack":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.useAck = b
+		case "ack_poll_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.ackPoll = time.Duration(i) * time.Second
+		case "ack_timeout":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.ackTimeout = time.Duration(i) * time.Second
+		case "batch_size":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchSize = i
+		case "batch_bytes":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.batchBytes = i
+		case "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		default:
+			break
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplunkHECAck(t *testing.T) {
+
+	var mu sync.Mutex
+	events := []hecEvent{}
+	polls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Splunk secret" || r.Header.Get("X-Splunk-Request-Channel") != "chan-1" {
+			http.Error(w, `{"text":"Invalid token","code":4}`, http.StatusUnauthorized)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case HEC_EVENT_PATH:
+			dec := json.NewDecoder(bytes.NewReader(body))
+			for dec.More() {
+				e := hecEvent{}
+				if err := dec.Decode(&e); err != nil {
+					t.Error(err.Error())
+				}
+				events = append(events, e)
+			}
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case HEC_ACK_PATH:
+			// indexed on the second poll
+			polls += 1
+			w.Write([]byte(`{"acks":{"7":` + map[bool]string{true: "true", false: "false"}[polls > 1] + `}}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSplunkStream(ctx, testFormat, server.URL+HEC_EVENT_PATH, "test", []string{
+		"token: secret",
+		"channel: chan-1",
+		"index: main",
+		"use_ack: true",
+		"ack_poll_interval: 0",
+	})
+
+	acked := make(chan bool, 2)
+	for _, level := range []string{"info", "\\N"} {
+		r := NewRecord("", testFormat, map[string]string{
+			"event_datetime": "2017-01-01T00:00:01.5Z",
+			"hostname":       "web-1",
+			"filename":       "/var/log/app.log",
+			"log_level":      level,
+			"log_line":       "GET /",
+		})
+		r.logfile = "nginx"
+		r.SetAck(func() { acked <- true })
+		s.Stream(r)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second * 10):
+			t.Fatalf("only %d of 2 events acked", i)
+		}
+	}
+	cancel()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if polls != 2 {
+		t.Fatalf("expected the events to be acked after the second poll, got %d polls", polls)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	e := events[0]
+	if e.Time != 1483228801.5 || e.Host != "web-1" || e.Source != "/var/log/app.log" || e.Sourcetype != "nginx" || e.Index != "main" || e.Event != "GET /" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e.Fields["log_level"] != "info" || e.Fields["log_line"] != "" {
+		t.Fatalf("unexpected fields %v", e.Fields)
+	}
+	if _, ok := events[1].Fields["log_level"]; ok {
+		t.Fatalf("null attributes should not be sent as fields: %v", events[1].Fields)
+	}
+}
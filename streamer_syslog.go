@@ -0,0 +1,382 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	SYSLOG_BATCH_SIZE        = 100
+	SYSLOG_MAX_RETRY_DEFAULT = 5
+	SYSLOG_WRITE_TIMEOUT     = time.Second * 30
+	SYSLOG_SD_ID_DEFAULT     = "pushr@32473"
+	SYSLOG_TIMESTAMP         = "2006-01-02T15:04:05.000000Z07:00"
+	SYSLOG_NILVALUE          = "-"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg":       0,
+	"emergency":   0,
+	"panic":       0,
+	"alert":       1,
+	"crit":        2,
+	"critical":    2,
+	"fatal":       2,
+	"err":         3,
+	"error":       3,
+	"warn":        4,
+	"warning":     4,
+	"notice":      5,
+	"info":        6,
+	"information": 6,
+	"debug":       7,
+	"trace":       7,
+}
+
+// SyslogStream forwards records to a syslog collector as RFC 5424 messages.
+// Over tcp and tls messages are framed with octet counting (RFC 6587).
+type SyslogStream struct {
+	ctx          context.Context
+	done         chan bool
+	conn         net.Conn
+	address      string
+	protocol     string
+	tlsConfig    *tls.Config
+	facility     int
+	sdId         string
+	msgId        string
+	interval     time.Duration
+	maxRetry     int
+	dataChan     chan encodedRecord
+	recordFormat []Attribute
+}
+
+func NewSyslogStream(ctx context.Context, recordFormat []Attribute, url, streamName string, options []string) *SyslogStream {
+
+	opts := ParseOptions(options)
+	s := parseSyslogOptions(opts)
+
+	if s.address == "" {
+		s.address = url
+	}
+	if s.address == "" {
+		log.Fatalf("syslog stream %s needs an address", streamName)
+	}
+
+	if s.protocol == "tls" {
+		s.tlsConfig = parseTLSOptions(opts)
+		if s.tlsConfig == nil {
+			s.tlsConfig = &tls.Config{}
+		}
+		if s.tlsConfig.ServerName == "" {
+			s.tlsConfig.ServerName, _, _ = net.SplitHostPort(s.address)
+		}
+	}
+
+	s.ctx = ctx
+	s.done = make(chan bool)
+	s.dataChan = make(chan encodedRecord, SYSLOG_BATCH_SIZE*2)
+	s.recordFormat = recordFormat
+
+	go s.intervalStreamer()
+
+	return s
+}
+
+func (s *SyslogStream) Stream(r *Record) error {
+	s.dataChan <- encodedRecord{s.format(r), r.Ack}
+	return nil
+}
+
+// format builds the RFC 5424 message of a record:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID PARAM="VALUE"...] MSG
+func (s *SyslogStream) format(r *Record) []byte {
+
+	timestamp := SYSLOG_NILVALUE
+	if t, err := time.Parse(ISO_8601, r.EventAttributes["event_datetime"]); err == nil {
+		timestamp = t.UTC().Format(SYSLOG_TIMESTAMP)
+	}
+
+	msg := r.EventAttributes["log_line"]
+	if msg == "" {
+		msg = r.rawLine
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s %s ",
+		s.facility*8+syslogSeverity(r.EventAttributes["log_level"]),
+		timestamp,
+		syslogHeaderField(r.EventAttributes["hostname"], 255),
+		syslogHeaderField(r.EventAttributes["app"], 48),
+		SYSLOG_NILVALUE,
+		syslogHeaderField(s.msgId, 32))
+
+	params := []string{}
+	for _, attr := range s.recordFormat {
+		switch attr.Key {
+		case "log_line", "event_datetime", "hostname", "app":
+			continue
+		}
+		val := r.EventAttributes[attr.Key]
+		if isUnset(val) {
+			continue
+		}
+		params = append(params, fmt.Sprintf(`%s="%s"`, syslogParamName(attr.Key), syslogParamValue(val)))
+	}
+	sort.Strings(params)
+
+	if len(params) > 0 {
+		buf.WriteString("[" + s.sdId + " " + strings.Join(params, " ") + "]")
+	} else {
+		buf.WriteString(SYSLOG_NILVALUE)
+	}
+
+	if msg != "" {
+		buf.WriteString(" " + msg)
+	}
+
+	return buf.Bytes()
+}
+
+// syslogSeverity maps log_level to a severity. Numeric levels are taken as
+// severities, or as http status codes when they have 3 digits.
+func syslogSeverity(level string) int {
+
+	if severity, ok := syslogSeverities[strings.ToLower(strings.TrimSpace(level))]; ok {
+		return severity
+	}
+
+	if i, err := strconv.Atoi(level); err == nil {
+		switch {
+		case i >= 0 && i <= 7:
+			return i
+		case i >= 500 && i <= 599:
+			return syslogSeverities["err"]
+		case i >= 400 && i <= 499:
+			return syslogSeverities["warning"]
+		}
+	}
+
+	return syslogSeverities["info"]
+}
+
+// syslogHeaderField makes a value fit a header field: printable ascii
+// without spaces, truncated to max, - when empty.
+func syslogHeaderField(val string, max int) string {
+
+	if isUnset(val) {
+		return SYSLOG_NILVALUE
+	}
+
+	field := []byte{}
+	for i := 0; i < len(val) && len(field) < max; i++ {
+		if val[i] > 32 && val[i] < 127 {
+			field = append(field, val[i])
+		}
+	}
+
+	if len(field) == 0 {
+		return SYSLOG_NILVALUE
+	}
+	return string(field)
+}
+
+func syslogParamName(key string) string {
+	name := []byte{}
+	for i := 0; i < len(key) && len(name) < 32; i++ {
+		c := key[i]
+		if c > 32 && c < 127 && c != '=' && c != ']' && c != '"' {
+			name = append(name, c)
+		}
+	}
+	return string(name)
+}
+
+func syslogParamValue(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(val)
+}
+
+func (s *SyslogStream) Close() {
+	<-s.done
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *SyslogStream) intervalStreamer() {
+
+	msgs := [][]byte{}
+	acks := []func(){}
+	timer := time.NewTicker(s.interval)
+	exit := false
+LOOP:
+	for {
+
+		flush := false
+
+		select {
+		case data := <-s.dataChan:
+			msgs = append(msgs, data.data)
+			acks = append(acks, data.ack)
+		case <-timer.C:
+			flush = true
+		case <-s.ctx.Done():
+			flush = true
+			log.Printf("context done. Force Flush")
+			exit = true
+		}
+
+		if (len(msgs) >= SYSLOG_BATCH_SIZE || flush) && len(msgs) > 0 {
+			// messages share one connection, they're written in order
+			// here instead of in upload goroutines
+			s.send(msgs, acks)
+			msgs = [][]byte{}
+			acks = []func(){}
+		}
+
+		if exit {
+			close(s.done)
+			break LOOP
+		}
+	}
+}
+
+func (s *SyslogStream) send(msgs [][]byte, acks []func()) {
+
+	failCount := 0
+	for i := 0; i < len(msgs); {
+
+		if failCount > s.maxRetry {
+			dropRecords(acks[i:], "retry count exceeded %v for syslog messages to %s", s.maxRetry, s.address)
+			return
+		}
+
+		var sleepTime = time.Duration(math.Min(60.0, float64(5*failCount))) * time.Second
+		if sleepTime > time.Duration(0) {
+			log.Warnf("Retrying %v syslog messages in %v seconds", len(msgs)-i, sleepTime)
+		}
+		time.Sleep(sleepTime)
+
+		if err := s.write(msgs[i]); err != nil {
+			log.Errorf("error writing to syslog %s: %s", s.address, err.Error())
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+			failCount += 1
+			continue
+		}
+
+		acks[i]()
+		i += 1
+		failCount = 0
+	}
+}
+
+func (s *SyslogStream) write(msg []byte) error {
+
+	if s.conn == nil {
+		var conn net.Conn
+		var err error
+		switch s.protocol {
+		case "tls":
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: SYSLOG_WRITE_TIMEOUT}, "tcp", s.address, s.tlsConfig)
+		default:
+			conn, err = net.DialTimeout(s.protocol, s.address, SYSLOG_WRITE_TIMEOUT)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(SYSLOG_WRITE_TIMEOUT))
+
+	var err error
+	if s.protocol == "udp" {
+		_, err = s.conn.Write(msg)
+	} else {
+		_, err = s.conn.Write(append([]byte(strconv.Itoa(len(msg))+" "), msg...))
+	}
+
+	return err
+}
+
+func (s *SyslogStream) RecordFormat() []Attribute {
+	return s.recordFormat
+}
+
+func parseSyslogOptions(opts map[string]string) *SyslogStream {
+
+	s := &SyslogStream{
+		protocol: "udp",
+		facility: syslogFacilities["user"],
+		sdId:     SYSLOG_SD_ID_DEFAULT,
+		msgId:    SYSLOG_NILVALUE,
+		interval: time.Second,
+		maxRetry: SYSLOG_MAX_RETRY_DEFAULT,
+	}
+
+	for key, val := range opts {
+		switch key {
+		case "address":
+			s.address = val
+		case "protocol":
+			if val != "udp" && val != "tcp" && val != "tls" {
+				log.Fatalf("syslog protocol %s not supported", val)
+			}
+			s.protocol = val
+		case "facility":
+			facility, ok := syslogFacilities[val]
+			if !ok {
+				log.Fatalf("syslog facility %s not supported", val)
+			}
+			s.facility = facility
+		case "sd_id":
+			s.sdId = syslogParamName(val)
+		case "msg_id":
+			s.msgId = val
+		case "buffer_interval":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.interval = time.Duration(i) * time.Second
+		case "max_retry":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			s.maxRetry = i
+		default:
+			break
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogTCP(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			// octet counting: MSG-LEN SP SYSLOG-MSG
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSyslogStream(ctx, testFormat, ln.Addr().String(), "test", []string{
+		"protocol: tcp",
+		"facility: local0",
+		"msg_id: access",
+	})
+
+	s.Stream(NewRecord("", testFormat, map[string]string{
+		"event_datetime": "2017-01-01T00:00:01.5Z",
+		"app":            "web",
+		"hostname":       "web-1",
+		"log_level":      "503",
+		"path":           `/a"b]`,
+		"log_line":       "GET /a",
+	}))
+	s.Stream(NewRecord("", testFormat, map[string]string{
+		"app":       "web app",
+		"hostname":  "\\N",
+		"log_level": "debug",
+		"path":      "\\N",
+		"log_line":  "hello",
+	}))
+
+	want := []string{
+		`<131>1 2017-01-01T00:00:01.500000Z web-1 web - access [pushr@32473 log_level="503" path="/a\"b\]"] GET /a`,
+		`<135>1 - - webapp - access [pushr@32473 log_level="debug"] hello`,
+	}
+	for _, w := range want {
+		select {
+		case msg := <-received:
+			if msg != w {
+				t.Fatalf("unexpected message\n got %s\nwant %s", msg, w)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not received")
+		}
+	}
+
+	cancel()
+	s.Close()
+}
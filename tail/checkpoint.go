@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package tail
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	FINGERPRINT_SIZE = 1024
+
+	ROTATION_TRUNCATED = "truncated" // copytruncate, same file from the start
+	ROTATION_REPLACED  = "replaced"  // renamed or removed and a new file created
+	ROTATION_REMOVED   = "removed"   // gone and nothing in its place yet
+	ROTATION_CREATED   = "created"   // recreated after being removed
+)
+
+// Checkpoint is the position right after the last line read from a file.
+// Dev/Ino identify the file on disk and Fingerprint is the md5 of the
+// first min(Offset, FINGERPRINT_SIZE) bytes, so a checkpoint is only
+// reused when it still points into the same content.
+type Checkpoint struct {
+	Offset      int64
+	Dev         uint64
+	Ino         uint64
+	Fingerprint string
+}
+
+// Line is a line read from the file. Offset is where the line starts and
+// Checkpoint is where reading should resume once the line is handled.
+// When Rotation is set there is no text, the file was rotated and
+// Checkpoint is the start of the file now being read.
+type Line struct {
+	Text       string
+	Offset     int64
+	Checkpoint Checkpoint
+	Rotation   *Rotation
+}
+
+// Rotation describes why the tail moved to the start of a file. Offset is
+// how far the previous file had been read.
+type Rotation struct {
+	Reason string
+	Offset int64
+}
+
+// Matches reports if the checkpoint can be used to resume reading f.
+// Short fingerprints are easy to collide with so for those the inode
+// has to match as well.
+func (cp *Checkpoint) Matches(f *os.File) bool {
+
+	if cp.Offset == 0 {
+		return true
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return cp.matches(f, fi.Size())
+}
+
+// matches checks the checkpoint against the content of src, size is the
+// length of that content.
+func (cp *Checkpoint) matches(src source, size int64) bool {
+
+	if size < cp.Offset {
+		return false
+	}
+
+	fp, n, err := fingerprint(src, cp.Offset)
+	if err != nil || fp != cp.Fingerprint {
+		return false
+	}
+
+	fi, err := src.Stat()
+	if err != nil {
+		return false
+	}
+
+	dev, ino := fileID(fi)
+	return n == FINGERPRINT_SIZE || (dev == cp.Dev && ino == cp.Ino)
+}
+
+// source is what lines are read from, a file or the decompressed content
+// of a gzipped one.
+type source interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+type position struct {
+	file  source
+	cp    Checkpoint
+	fpLen int64
+}
+
+func newPosition(f source, offset int64) *position {
+
+	p := &position{file: f}
+	if fi, err := f.Stat(); err == nil {
+		p.cp.Dev, p.cp.Ino = fileID(fi)
+	}
+	p.cp.Offset = offset
+	p.cp.Fingerprint, p.fpLen, _ = fingerprint(f, offset)
+
+	return p
+}
+
+// advance moves the position n bytes forward and returns a line starting
+// at the old offset.
+func (p *position) advance(text string, n int) Line {
+
+	line := Line{Text: text, Offset: p.cp.Offset}
+	p.cp.Offset += int64(n)
+
+	// the fingerprint only covers what has been read, keep growing it
+	// until it reaches FINGERPRINT_SIZE
+	if p.fpLen < FINGERPRINT_SIZE && p.cp.Offset > p.fpLen {
+		if fp, fpLen, err := fingerprint(p.file, p.cp.Offset); err == nil {
+			p.cp.Fingerprint, p.fpLen = fp, fpLen
+		}
+	}
+
+	line.Checkpoint = p.cp
+	return line
+}
+
+func (p *position) rotation(reason string, offset int64) Line {
+	return Line{
+		Offset:     p.cp.Offset,
+		Checkpoint: p.cp,
+		Rotation:   &Rotation{Reason: reason, Offset: offset},
+	}
+}
+
+func fingerprint(f io.ReaderAt, offset int64) (string, int64, error) {
+
+	size := offset
+	if size > FINGERPRINT_SIZE {
+		size = FINGERPRINT_SIZE
+	}
+
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(buf[:n])), int64(n), nil
+}
@@ -36,15 +36,18 @@ func main() {
 		wg.Add(1)
 		go func(path string) {
 
-			t := tail.NewTailWithCtx(context.Background(), path, false, true, fls, true, false)
+			t := tail.NewTailWithCtx(context.Background(), path, false, true, fls, true, false, nil, nil)
 
 			n := 1
 			for {
 				line := <-t.LineChan
-				if ok := utf8.ValidString(line); !ok {
+				if line.Rotation != nil {
+					continue
+				}
+				if ok := utf8.ValidString(line.Text); !ok {
 					fmt.Print("line %d not UTF-8: ", n)
 				}
-				fmt.Println(line)
+				fmt.Println(line.Text)
 				n += 1
 			}
 			wg.Done()
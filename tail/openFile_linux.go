@@ -1,8 +1,18 @@
 package tail
 
-import "os"
+import (
+	"os"
+	"syscall"
+)
 
 func tailFileOpen(path string) (*os.File, error) {
 	f, err := os.Open(path)
 	return f, err
 }
+
+func fileID(fi os.FileInfo) (uint64, uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
@@ -21,6 +21,12 @@ func tailFileOpen(path string) (*os.File, error) {
 	return f, nil
 }
 
+// fileID is not available from os.FileInfo on windows, checkpoints
+// fall back to the fingerprint only.
+func fileID(fi os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
+
 func open(path string, mode int, perm uint32) (fd syscall.Handle, err error) {
 	if len(path) == 0 {
 		return syscall.InvalidHandle, syscall.ERROR_FILE_NOT_FOUND
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package tail
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Backlog returns the files matching pattern that were rotated out of path
+// while nobody was reading, oldest first. The first one is the file cp
+// points into. Without a checkpoint, or when cp still points into path,
+// there is nothing to catch up on.
+func Backlog(path, pattern string, cp *Checkpoint) []string {
+
+	if cp == nil || pattern == "" {
+		return nil
+	}
+
+	live, err := os.Stat(path)
+	if err == nil {
+		if f, err := os.Open(path); err == nil {
+			matches := cp.Matches(f)
+			f.Close()
+			if matches {
+				return nil
+			}
+		}
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		log.WithField("file", path).Errorf("bad rotated pattern %s. %s", pattern, err.Error())
+		return nil
+	}
+
+	type rotatedFile struct {
+		path    string
+		modTime time.Time
+	}
+
+	rotated := []rotatedFile{}
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil || fi.IsDir() || (live != nil && os.SameFile(fi, live)) {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{m, fi.ModTime()})
+	}
+
+	sort.SliceStable(rotated, func(i, j int) bool {
+		return rotated[i].modTime.Before(rotated[j].modTime)
+	})
+
+	for i, r := range rotated {
+		if matchesRotated(r.path, cp) {
+			backlog := []string{}
+			for _, r := range rotated[i:] {
+				backlog = append(backlog, r.path)
+			}
+			return backlog
+		}
+	}
+
+	log.WithField("file", path).Warnf("checkpoint at offset %d not found in rotated files", cp.Offset)
+	return nil
+}
+
+func matchesRotated(path string, cp *Checkpoint) bool {
+
+	src, r, err := openRotated(path)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+
+	size, _ := io.CopyN(ioutil.Discard, r, cp.Offset)
+	if cp.matches(src, size) {
+		return true
+	}
+
+	// a gzipped copy never has the inode of the file cp was taken on, and
+	// files under FINGERPRINT_SIZE never get a full fingerprint. for
+	// rotated files a match of every byte cp has a fingerprint of is enough
+	if cp.Offset == 0 || size < cp.Offset {
+		return false
+	}
+	want := cp.Offset
+	if want > FINGERPRINT_SIZE {
+		want = FINGERPRINT_SIZE
+	}
+	fp, n, err := fingerprint(src, cp.Offset)
+	return err == nil && fp == cp.Fingerprint && n == want
+}
+
+type rotatedSource interface {
+	source
+	Close() error
+}
+
+// openRotated opens a rotated file, decompressing it if it's gzipped.
+func openRotated(path string) (rotatedSource, io.Reader, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return f, f, nil
+	}
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return gzipSource{f}, r, nil
+}
+
+// gzipSource reads at offsets of the decompressed content. It starts over
+// for every read, fingerprints only ever look at the start of the file.
+type gzipSource struct {
+	*os.File
+}
+
+func (g gzipSource) ReadAt(p []byte, off int64) (int, error) {
+
+	r, err := gzip.NewReader(io.NewSectionReader(g.File, 0, 1<<62))
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, off); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
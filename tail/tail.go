@@ -14,6 +14,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
@@ -26,6 +27,8 @@ import (
 const (
 	SLEEP_TIMEOUT = time.Second * 1
 	FD_TIMEOUT    = time.Minute * 5
+	ROTATE_GRACE  = SLEEP_TIMEOUT * 2
+	STDIN         = "-"
 )
 
 var (
@@ -34,7 +37,7 @@ var (
 
 type Tail struct {
 	Filename       string
-	LineChan       chan string
+	LineChan       chan Line
 	Cancel         context.CancelFunc
 	Follow         bool
 	Context        context.Context
@@ -42,6 +45,8 @@ type Tail struct {
 	lineStartSplit bool // logic for handling begining of line split (splunk like, by timestamp)
 	delim          *regexp.Regexp
 	SeekToEnd      bool
+	Checkpoint     *Checkpoint // resume from here if it still matches the file
+	Backlog        []string    // rotated files to read first, see Backlog()
 }
 
 func NewTail(path string) *Tail {
@@ -50,7 +55,7 @@ func NewTail(path string) *Tail {
 
 	t := &Tail{
 		Filename:       path,
-		LineChan:       make(chan string),
+		LineChan:       make(chan Line),
 		Cancel:         cancel,
 		Follow:         true,
 		Context:        ctx,
@@ -67,7 +72,7 @@ func (t *Tail) Start() {
 	go t.watchFile(t.Context, t.Filename)
 }
 
-func NewTailWithCtx(ctx context.Context, path string, follow, retryFileOpen bool, delim *regexp.Regexp, lineStartSplit bool, skipToEnd bool) *Tail {
+func NewTailWithCtx(ctx context.Context, path string, follow, retryFileOpen bool, delim *regexp.Regexp, lineStartSplit bool, skipToEnd bool, checkpoint *Checkpoint, backlog []string) *Tail {
 
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -78,7 +83,7 @@ func NewTailWithCtx(ctx context.Context, path string, follow, retryFileOpen bool
 
 	t := &Tail{
 		Filename:       path,
-		LineChan:       make(chan string),
+		LineChan:       make(chan Line),
 		Cancel:         cancel,
 		Follow:         follow,
 		Context:        ctx,
@@ -86,6 +91,8 @@ func NewTailWithCtx(ctx context.Context, path string, follow, retryFileOpen bool
 		lineStartSplit: lineStartSplit,
 		delim:          d,
 		SeekToEnd:      skipToEnd,
+		Checkpoint:     checkpoint,
+		Backlog:        backlog,
 	}
 
 	t.Start()
@@ -104,7 +111,7 @@ func (t *Tail) Close() {
 	close(t.LineChan)
 }
 
-func (t *Tail) openFile(path string) (*os.File, error) {
+func (t *Tail) openFile(path string) (*os.File, int64, error) {
 
 	var f *os.File
 	var err error
@@ -113,7 +120,7 @@ func (t *Tail) openFile(path string) (*os.File, error) {
 		if !t.RetryFileOpen {
 			select {
 			case <-t.Context.Done():
-				return nil, errors.New("Tail context cancelled.")
+				return nil, 0, errors.New("Tail context cancelled.")
 			default:
 				break
 			}
@@ -124,27 +131,54 @@ func (t *Tail) openFile(path string) (*os.File, error) {
 			log.Infof("Unable to open. %s. Waiting 5 seconds and retrying", err.Error())
 			time.Sleep(time.Second * 5)
 		} else {
-			if finfo, err := os.Stat(path); err == nil && t.SeekToEnd {
-				f.Seek(finfo.Size(), 0)
-			}
 			break
 		}
 	}
 
-	return f, nil
+	var offset int64
+	if t.Checkpoint != nil {
+		if t.Checkpoint.Matches(f) {
+			offset = t.Checkpoint.Offset
+		} else {
+			log.WithField("file", path).Warnf("checkpoint at offset %d does not match file. Reading from the start", t.Checkpoint.Offset)
+		}
+		// only the first open resumes, files reopened after a rename start over
+		t.Checkpoint = nil
+	} else if finfo, err := f.Stat(); err == nil && t.SeekToEnd {
+		offset = finfo.Size()
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, offset, nil
 }
 
 func (t *Tail) watchFile(ctx context.Context, path string) {
 
-	fileIn, err := t.openFile(path)
+	if IsStream(path) {
+		t.readStream(ctx, path)
+		return
+	}
+
+	if len(t.Backlog) > 0 && !t.readBacklog(ctx) {
+		return
+	}
+
+	fileIn, offset, err := t.openFile(path)
 	if err != nil {
 		log.Infof("1. Unable to openFile. %s", err.Error())
 		//os.Exit(0)
 		return
 	}
-	defer fileIn.Close()
+	defer func() {
+		fileIn.Close()
+	}()
 
 	r := bufio.NewReader(fileIn)
+	pos := newPosition(fileIn, offset)
 
 	accum := new(bytes.Buffer)
 
@@ -158,76 +192,283 @@ func (t *Tail) watchFile(ctx context.Context, path string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	done := make(chan bool)
 
-	for {
+	// set once path no longer points at fileIn. The old fd is drained
+	// until it has been quiet for ROTATE_GRACE before moving on.
+	var rotatedAt, lastRead time.Time
+	removed := false
 
-		if t.lineStartSplit {
-			readFrontSplit(ctx, t.delim, t.LineChan, r, accum)
-		} else {
-			buffer := read(ctx, t.delim, r, accum)
-			reader := bufio.NewReader(buffer)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					break
-				}
-
-				line, err := reader.ReadString('\n')
-				if err != nil && err != io.EOF {
-					log.WithField("file", path).Error(err.Error())
-					break
-
-				}
+	for {
 
-				if len(line) > 0 {
-					t.LineChan <- string([]rune(strings.TrimRight(line, "\n")))
-				}
+		n, ok := t.readLines(ctx, path, r, accum, pos)
+		if !ok {
+			return
+		}
 
-				if err == io.EOF {
-					if !t.Follow {
-						t.Close()
-						return
-					}
-					break
-				}
+		if !t.Follow && !t.lineStartSplit {
+			t.Close()
+			return
+		}
 
-			}
+		if n > 0 {
+			lastRead = time.Now()
 		}
 
 		select {
 		case <-time.After(SLEEP_TIMEOUT):
 			if t.lineStartSplit && accum.Len() > 0 {
-				t.LineChan <- accum.String()
+				t.LineChan <- pos.advance(accum.String(), accum.Len())
 				accum.Reset()
 			}
 			break
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Rename == fsnotify.Rename {
-				log.WithField("file", path).Info("File renamed. Monitoring old fd for 5 minutes")
-				go t.watchFile(ctx, path)
-				time.AfterFunc(FD_TIMEOUT, func() {
-					done <- true
-				})
-			}
+		case <-watcher.Events:
+			// the file is checked below whatever the event was
 			break
 		case err := <-watcher.Errors:
 			log.WithField("file", path).Errorf("inotify error: %v", err)
 			break
-		case <-done:
-			log.WithField("file", path).Info("Closing old fd")
-			return
 		case <-ctx.Done():
 			if accum.Len() > 0 {
-				t.LineChan <- accum.String()
+				t.LineChan <- pos.advance(accum.String(), accum.Len())
 				accum.Reset()
 			}
 			t.Close()
 			return
 		}
+
+		if fi, err := fileIn.Stat(); err == nil && fi.Size() < pos.cp.Offset {
+			// copytruncate, the same file starts over
+			log.WithField("file", path).Warnf("file truncated from %d to %d bytes. Reading from the start", pos.cp.Offset, fi.Size())
+			t.flushAccum(accum, pos)
+			if _, err := fileIn.Seek(0, io.SeekStart); err != nil {
+				log.WithField("file", path).Errorf("unable to seek. %s", err.Error())
+				continue
+			}
+			old := pos.cp.Offset
+			r.Reset(fileIn)
+			pos = newPosition(fileIn, 0)
+			t.LineChan <- pos.rotation(ROTATION_TRUNCATED, old)
+			continue
+		}
+
+		current, exists := pathState(path, fileIn)
+		if current {
+			rotatedAt = time.Time{}
+			continue
+		}
+
+		if rotatedAt.IsZero() {
+			log.WithField("file", path).Info("File renamed or removed. Draining old fd")
+			rotatedAt = time.Now()
+			continue
+		}
+
+		quiet := time.Since(rotatedAt) >= ROTATE_GRACE && time.Since(lastRead) >= ROTATE_GRACE
+		if !quiet && time.Since(rotatedAt) < FD_TIMEOUT {
+			continue
+		}
+
+		if !exists {
+			if !removed {
+				log.WithField("file", path).Warn("File removed. Waiting for it to be recreated")
+				t.flushAccum(accum, pos)
+				t.LineChan <- Line{Rotation: &Rotation{Reason: ROTATION_REMOVED, Offset: pos.cp.Offset}}
+				removed = true
+			}
+			continue
+		}
+
+		f, err := tailFileOpen(path)
+		if err != nil {
+			log.WithField("file", path).Warnf("unable to reopen. %s", err.Error())
+			continue
+		}
+
+		log.WithField("file", path).Info("File replaced. Closing old fd")
+		t.flushAccum(accum, pos)
+		old := pos.cp.Offset
+		fileIn.Close()
+		fileIn = f
+		r.Reset(fileIn)
+		pos = newPosition(fileIn, 0)
+		rotatedAt = time.Time{}
+
+		watcher.Remove(path)
+		if err := watcher.Add(path); err != nil {
+			log.WithField("file", path).Errorf("unable to watch. %s", err.Error())
+		}
+
+		if removed {
+			removed = false
+			t.LineChan <- pos.rotation(ROTATION_CREATED, 0)
+		} else {
+			t.LineChan <- pos.rotation(ROTATION_REPLACED, old)
+		}
+	}
+}
+
+// IsStream reports if path is stdin ("-") or a named pipe. Those are read
+// once up to EOF, there's nothing to seek, watch or resume.
+func IsStream(path string) bool {
+
+	if path == STDIN {
+		return true
+	}
+
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// readStream reads stdin or a named pipe until the writer closes it.
+func (t *Tail) readStream(ctx context.Context, path string) {
+
+	defer t.Close()
+
+	f := os.Stdin
+	if path != STDIN {
+		// opening a pipe blocks until something opens it for writing
+		opened := make(chan *os.File, 1)
+		go func() {
+			f, err := os.Open(path)
+			if err != nil {
+				log.WithField("file", path).Errorf("unable to open pipe. %s", err.Error())
+			}
+			opened <- f
+		}()
+
+		select {
+		case f = <-opened:
+			if f == nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
+
+	defer f.Close()
+
+	// unblocks the read on shutdown, stdin only when it's pollable
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Close()
+		case <-done:
+		}
+	}()
+
+	accum := new(bytes.Buffer)
+	pos := newPosition(f, 0)
+	if _, ok := t.readLines(ctx, path, bufio.NewReader(f), accum, pos); !ok {
+		return
+	}
+	t.flushAccum(accum, pos)
+
+	log.WithField("file", path).Info("end of stream")
+}
+
+// readLines sends every line up to the end of r, returning how many bytes
+// were read and false if the tail was cancelled.
+func (t *Tail) readLines(ctx context.Context, path string, r io.Reader, accum *bytes.Buffer, pos *position) (int64, bool) {
+
+	if t.lineStartSplit {
+		// cancellation is handled by the caller so the last event is flushed
+		return readFrontSplit(ctx, t.delim, t.LineChan, r, accum, pos), true
+	}
+
+	n := int64(0)
+	buffer := read(ctx, t.delim, r, accum)
+	reader := bufio.NewReader(buffer)
+	for {
+		select {
+		case <-ctx.Done():
+			return n, false
+		default:
+			break
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.WithField("file", path).Error(err.Error())
+			return n, true
+		}
+
+		if len(line) > 0 {
+			n += int64(len(line))
+			t.LineChan <- pos.advance(string([]rune(strings.TrimRight(line, "\n"))), len(line))
+		}
+
+		if err == io.EOF {
+			return n, true
+		}
+	}
+}
+
+// readBacklog reads the rotated files in t.Backlog before the live file is
+// opened. The checkpoint points into the first one, the live file is then
+// read from the start.
+func (t *Tail) readBacklog(ctx context.Context) bool {
+
+	for i, path := range t.Backlog {
+
+		src, r, err := openRotated(path)
+		if err != nil {
+			log.WithField("file", path).Warnf("unable to open rotated file. %s", err.Error())
+			continue
+		}
+
+		offset := int64(0)
+		if i == 0 && t.Checkpoint != nil {
+			offset = t.Checkpoint.Offset
+			if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+				log.WithField("file", path).Warnf("unable to skip to offset %d. %s", offset, err.Error())
+				src.Close()
+				continue
+			}
+		}
+
+		log.WithField("file", path).Infof("reading rotated file from offset %d", offset)
+
+		accum := new(bytes.Buffer)
+		pos := newPosition(src, offset)
+		_, ok := t.readLines(ctx, path, bufio.NewReader(r), accum, pos)
+		src.Close()
+		if !ok || ctx.Err() != nil {
+			return false
+		}
+		t.flushAccum(accum, pos)
+	}
+
+	t.Checkpoint = nil
+	t.SeekToEnd = false
+	return true
+}
+
+// flushAccum sends the partial line left over when the file goes away.
+func (t *Tail) flushAccum(accum *bytes.Buffer, pos *position) {
+	if accum.Len() > 0 {
+		t.LineChan <- pos.advance(accum.String(), accum.Len())
+		accum.Reset()
+	}
+}
+
+// pathState reports if path still points at f and if there is anything
+// at path at all.
+func pathState(path string, f *os.File) (bool, bool) {
+
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false, false
+	}
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false, true
+	}
+
+	return os.SameFile(pathInfo, fileInfo), true
 }
 
 func read(ctx context.Context, delim *regexp.Regexp, f io.Reader, accum *bytes.Buffer) io.Reader {
@@ -248,8 +489,9 @@ func read(ctx context.Context, delim *regexp.Regexp, f io.Reader, accum *bytes.B
 				break
 			}
 
+			// readers like gzip return the last bytes along with io.EOF
 			n, err := f.Read(buffer)
-			if err != nil {
+			if n == 0 && err != nil {
 				w.Close()
 				break
 			}
@@ -281,76 +523,51 @@ func read(ctx context.Context, delim *regexp.Regexp, f io.Reader, accum *bytes.B
 	return r
 }
 
-func readFrontSplit(ctx context.Context, delim *regexp.Regexp, lineChan chan string, f io.Reader, accum *bytes.Buffer) {
+func readFrontSplit(ctx context.Context, delim *regexp.Regexp, lineChan chan Line, f io.Reader, accum *bytes.Buffer, pos *position) int64 {
 
 	buffer_size := 1048576 // 1MB
-
-	// go func() {
-	// defer w.Close()
+	total := int64(0)
 
 	buffer := make([]byte, buffer_size)
-	first := true
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return total
 		default:
 			break
 		}
 
 		n, err := f.Read(buffer)
-		if err != nil {
+		if n == 0 && err != nil {
 			break
 		}
+		total += int64(n)
 
 		slice := buffer[:n]
 		locs := delim.FindAllSubmatchIndex(slice, -1)
 
 		if len(locs) == 0 {
 			accum.Write(slice)
-		} else {
-
-			line_begin_idx := 0
-			line_end_idx := 0
-			next_start := 0
-			for _, loc := range locs {
-				if first {
-					first = false
-					next_start = loc[0]
-					if loc[0] == 0 && accum.Len() > 0 {
-						lineChan <- accum.String()
-						accum.Reset()
-					}
-					continue
-				} else {
-					line_begin_idx = next_start
-				}
-
-				line_end_idx = loc[0]
-				next_start = loc[1] - (loc[1] - loc[0])
-				data := bytes.Replace(slice[line_begin_idx:line_end_idx], []byte("\x0A"), nil, -1)
-				data = append(accum.Bytes(), data...)
-				lineChan <- string(data)
-				accum.Reset()
-				// data_trim := bytes.TrimRight(data, "\n")
-				// log.Printf("%v -> %v", line_begin_idx, line_end_idx)
-				// fmt.Printf("\n-----line start %v -----\n%s\n-----line end %v -----\n", line_begin_idx, data_trim, line_end_idx)
-
-			}
+			continue
+		}
 
-			data := slice[next_start:n]
-			accum.Write(data)
-			// w.Write(data)
-			// lineChan <- string(data)
-			// data_trim := bytes.TrimRight(data, "\n")
-			// fmt.Printf("\n-----line start %v -----\n%s\n-----line end %v -----\n", next_start, data, n)
+		// whatever is before the first delimiter is the tail end of the
+		// line accumulated from the previous read
+		accum.Write(slice[:locs[0][0]])
+		if accum.Len() > 0 {
+			lineChan <- pos.advance(accum.String(), accum.Len())
+			accum.Reset()
 		}
-	}
 
-	// lineChan <- string(accum.Bytes())
-	// accum.Reset()
-	// }()
+		for i := 1; i < len(locs); i++ {
+			line_begin_idx := locs[i-1][0]
+			line_end_idx := locs[i][0]
+			data := bytes.Replace(slice[line_begin_idx:line_end_idx], []byte("\x0A"), nil, -1)
+			lineChan <- pos.advance(string(data), line_end_idx-line_begin_idx)
+		}
 
-	// <-ctx.Done()
+		accum.Write(slice[locs[len(locs)-1][0]:n])
+	}
 
+	return total
 }
@@ -9,11 +9,17 @@
 package tail
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 var fullText = `Lorem ipsum dolor sit amet, consectetur adipiscing elit.
@@ -59,29 +65,230 @@ func TestTail(t *testing.T) {
 	file.WriteString(startText)
 
 	tail := NewTail(file.Name())
+	tail.Start()
+	defer tail.Cancel()
 
-	_ = new(sync.Mutex)
+	m := new(sync.Mutex)
 
 	go func() {
 		for _, line := range extraLines {
 			t.Logf("%v", line)
-			// time.Sleep(time.Second * 1)
-			// m.Lock()
-			// file.WriteString(line)
-			// m.Unlock()
+			m.Lock()
+			file.WriteString(line + "\n")
+			m.Unlock()
 		}
 	}()
 
-	t.Log("here")
-
-	for i := 0; i < len(all_lines); i++ {
+	// fullText ends with a newline, the last element is empty
+	for i := 0; i < len(all_lines)-1; i++ {
 		line := <-tail.LineChan
-		t.Log(line)
-		if all_lines[i] != line {
+		t.Log(line.Text)
+		if all_lines[i] != line.Text {
 			t.Fatal("lines don't match")
 		}
 	}
 
-	// fmt.Println()
+}
+
+func TestTailCheckpoint(t *testing.T) {
+
+	file, err := ioutil.TempFile(os.TempDir(), "tail_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	file.WriteString(fullText)
+
+	first := NewTailWithCtx(context.Background(), file.Name(), false, false, nil, false, false, nil, nil)
+	var cp Checkpoint
+	for i := 0; i < 3; i++ {
+		line := <-first.LineChan
+		if line.Offset != cp.Offset {
+			t.Fatalf("line %d starts at %d, expected %d", i, line.Offset, cp.Offset)
+		}
+		cp = line.Checkpoint
+	}
+	first.Cancel()
+
+	if cp.Offset != int64(len(startText)) {
+		t.Fatalf("checkpoint at %d, expected %d", cp.Offset, len(startText))
+	}
+
+	resumed := NewTailWithCtx(context.Background(), file.Name(), false, false, nil, false, false, &cp, nil)
+	defer resumed.Cancel()
+	for _, expected := range extraLines {
+		line := <-resumed.LineChan
+		if line.Text != expected {
+			t.Fatalf("resumed at wrong line. got: %s expected: %s", line.Text, expected)
+		}
+	}
+
+	// a checkpoint for different content reads the file from the start
+	cp.Fingerprint = "ffffffffffffffffffffffffffffffff"
+	mismatched := NewTailWithCtx(context.Background(), file.Name(), false, false, nil, false, false, &cp, nil)
+	defer mismatched.Cancel()
+	if line := <-mismatched.LineChan; line.Text != all_lines[0] || line.Offset != 0 {
+		t.Fatalf("expected to start over, got offset %d: %s", line.Offset, line.Text)
+	}
+}
 
+func TestTailRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "tail_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte(startText), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tail := NewTailWithCtx(context.Background(), path, true, false, nil, false, false, nil, nil)
+	defer tail.Cancel()
+
+	for i := 0; i < 3; i++ {
+		<-tail.LineChan
+	}
+
+	// copytruncate
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	line := <-tail.LineChan
+	if line.Rotation == nil || line.Rotation.Reason != ROTATION_TRUNCATED || line.Rotation.Offset != int64(len(startText)) {
+		t.Fatalf("expected truncation, got %+v", line)
+	}
+	if err := ioutil.WriteFile(path, []byte(extraLines[0]+"\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if line := <-tail.LineChan; line.Text != extraLines[0] || line.Offset != 0 {
+		t.Fatalf("expected first line after truncation, got %+v", line)
+	}
+
+	// rename and create
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(path, []byte(extraLines[1]+"\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	line = <-tail.LineChan
+	if line.Rotation == nil || line.Rotation.Reason != ROTATION_REPLACED || line.Checkpoint.Offset != 0 {
+		t.Fatalf("expected replaced file, got %+v", line)
+	}
+	if line := <-tail.LineChan; line.Text != extraLines[1] {
+		t.Fatalf("expected first line of the new file, got %+v", line)
+	}
+}
+
+func TestTailBacklog(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "tail_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	old := new(bytes.Buffer)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(old, "old line %03d\n", i)
+	}
+	if err := ioutil.WriteFile(path, old.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	first := NewTailWithCtx(context.Background(), path, false, false, nil, false, false, nil, nil)
+	var cp Checkpoint
+	for i := 0; i < 90; i++ {
+		cp = (<-first.LineChan).Checkpoint
+	}
+	first.Cancel()
+
+	// rotated twice while nobody was reading, the oldest one compressed
+	compressed := new(bytes.Buffer)
+	wz := gzip.NewWriter(compressed)
+	wz.Write(old.Bytes())
+	wz.Close()
+	if err := ioutil.WriteFile(path+".2.gz", compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(path+".2.gz", hourAgo, hourAgo)
+	if err := ioutil.WriteFile(path+".1", []byte("rotated line\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	minuteAgo := time.Now().Add(-time.Minute)
+	os.Chtimes(path+".1", minuteAgo, minuteAgo)
+	if err := ioutil.WriteFile(path, []byte("live line\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	backlog := Backlog(path, path+".*", &cp)
+	if len(backlog) != 2 || backlog[0] != path+".2.gz" || backlog[1] != path+".1" {
+		t.Fatalf("unexpected backlog %v", backlog)
+	}
+
+	expected := []string{}
+	for i := 90; i < 100; i++ {
+		expected = append(expected, fmt.Sprintf("old line %03d", i))
+	}
+	expected = append(expected, "rotated line", "live line")
+
+	resumed := NewTailWithCtx(context.Background(), path, false, false, nil, false, false, &cp, backlog)
+	defer resumed.Cancel()
+	for _, text := range expected {
+		if line := <-resumed.LineChan; line.Text != text {
+			t.Fatalf("expected %s, got %s", text, line.Text)
+		}
+	}
+}
+
+func TestTailBacklogSmallFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "tail_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// under FINGERPRINT_SIZE, and compressed on rotation so the inode
+	// is gone too
+	path := filepath.Join(dir, "app.log")
+	old := new(bytes.Buffer)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(old, "old line %03d\n", i)
+	}
+	if err := ioutil.WriteFile(path, old.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	first := NewTailWithCtx(context.Background(), path, false, false, nil, false, false, nil, nil)
+	var cp Checkpoint
+	for i := 0; i < 5; i++ {
+		cp = (<-first.LineChan).Checkpoint
+	}
+	first.Cancel()
+
+	compressed := new(bytes.Buffer)
+	wz := gzip.NewWriter(compressed)
+	wz.Write(old.Bytes())
+	wz.Close()
+	if err := ioutil.WriteFile(path+".1.gz", compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(path, []byte("live line\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	backlog := Backlog(path, path+".*", &cp)
+	if len(backlog) != 1 || backlog[0] != path+".1.gz" {
+		t.Fatalf("unexpected backlog %v", backlog)
+	}
 }
@@ -0,0 +1,72 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package tail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTailPipe(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "tail_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pipe")
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !IsStream(path) || !IsStream(STDIN) || IsStream(dir) {
+		t.Fatal("expected only stdin and the pipe to be streams")
+	}
+
+	tail := NewTailWithCtx(context.Background(), path, true, false, nil, false, false, nil, nil)
+	defer tail.Cancel()
+
+	go func() {
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		w.Write([]byte(extraLines[0] + "\n" + extraLines[1] + "\n" + extraLines[2]))
+		w.Close()
+	}()
+
+	for _, text := range extraLines[:3] {
+		select {
+		case line := <-tail.LineChan:
+			if line.Text != text {
+				t.Fatalf("expected %s, got %s", text, line.Text)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for %s", text)
+		}
+	}
+
+	// the tail ends with the pipe even when following
+	select {
+	case line, ok := <-tail.LineChan:
+		if ok {
+			t.Fatalf("expected the tail to stop at the end of the pipe, got %+v", line)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("tail still running after the writer closed the pipe")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2016 Yanko Bolanos
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TransformConfig is one step of the transforms of a logfile, applied in
+// order to the attributes of every parsed line.
+//
+//	rename    field to `to`
+//	drop      field, or all of fields
+//	copy      field to `to`
+//	default   sets field to value when it's null
+//	set       sets field to value
+//	lowercase field
+//	replace   the matches of pattern in field with replacement, $1 and
+//	          ${name} are the groups of pattern
+//	split     field on separator into fields, the last one gets the rest
+//	cast      field to the record format type `to`: integer, double,
+//	          float32, float64, bool or string. null when it doesn't convert
+type TransformConfig struct {
+	Type        string   `yaml:"type" json:"type"`
+	Field       string   `yaml:"field" json:"field,omitempty"`
+	Fields      []string `yaml:"fields" json:"fields,omitempty"`
+	To          string   `yaml:"to" json:"to,omitempty"`
+	Value       string   `yaml:"value" json:"value,omitempty"`
+	Pattern     string   `yaml:"pattern" json:"pattern,omitempty"`
+	Replacement string   `yaml:"replacement" json:"replacement,omitempty"`
+	Separator   string   `yaml:"separator" json:"separator,omitempty"`
+	regex       *regexp.Regexp
+}
+
+// applyTransforms checks the transforms of a logfile and compiles their
+// patterns.
+func (l *Logfile) applyTransforms() error {
+
+	for i := range l.Transforms {
+		t := &l.Transforms[i]
+
+		if t.Field == "" && !(t.Type == "drop" && len(t.Fields) > 0) {
+			return fmt.Errorf("logfile %s transform %d (%s) needs a field", l.Name, i+1, t.Type)
+		}
+
+		switch t.Type {
+		case "drop", "default", "set", "lowercase":
+		case "rename", "copy":
+			if t.To == "" {
+				return fmt.Errorf("logfile %s transform %d (%s) needs to", l.Name, i+1, t.Type)
+			}
+		case "replace":
+			re, err := regexp.Compile(t.Pattern)
+			if err != nil {
+				return fmt.Errorf("logfile %s transform %d (replace) has invalid pattern: %s", l.Name, i+1, err.Error())
+			}
+			t.regex = re
+		case "split":
+			if t.Separator == "" || len(t.Fields) == 0 {
+				return fmt.Errorf("logfile %s transform %d (split) needs separator and fields", l.Name, i+1)
+			}
+		case "cast":
+			switch t.To {
+			case "integer", "double", "float32", "float64", "bool", "string":
+			default:
+				return fmt.Errorf("logfile %s transform %d (cast) has unknown type %s", l.Name, i+1, t.To)
+			}
+		default:
+			return fmt.Errorf("logfile %s has unknown transform %s", l.Name, t.Type)
+		}
+	}
+
+	return nil
+}
+
+// transformAttributes runs the transforms on the attributes of a line.
+func transformAttributes(transforms []TransformConfig, attributes map[string]string) {
+	for i := range transforms {
+		transforms[i].apply(attributes)
+	}
+}
+
+func (t *TransformConfig) apply(attributes map[string]string) {
+
+	val, ok := attributes[t.Field]
+	null := !ok || isUnset(val)
+
+	switch t.Type {
+	case "rename":
+		if ok {
+			attributes[t.To] = val
+			delete(attributes, t.Field)
+		}
+	case "drop":
+		delete(attributes, t.Field)
+		for _, field := range t.Fields {
+			delete(attributes, field)
+		}
+	case "copy":
+		if ok {
+			attributes[t.To] = val
+		}
+	case "default":
+		if null {
+			attributes[t.Field] = t.Value
+		}
+	case "set":
+		attributes[t.Field] = t.Value
+	case "lowercase":
+		if !null {
+			attributes[t.Field] = strings.ToLower(val)
+		}
+	case "replace":
+		if !null && t.regex != nil {
+			attributes[t.Field] = t.regex.ReplaceAllString(val, t.Replacement)
+		}
+	case "split":
+		if null {
+			break
+		}
+		parts := strings.SplitN(val, t.Separator, len(t.Fields))
+		for i, field := range t.Fields {
+			if i < len(parts) {
+				attributes[field] = parts[i]
+			} else {
+				attributes[field] = "\\N"
+			}
+		}
+	case "cast":
+		if !null {
+			attributes[t.Field] = castAttribute(val, t.To)
+		}
+	}
+}
+
+// castAttribute converts a value to how the record format writes the type,
+// 12.0 to 12 for an integer, yes to true for a bool.
+func castAttribute(val, to string) string {
+
+	val = strings.TrimSpace(val)
+
+	switch to {
+	case "integer":
+		if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return strconv.FormatInt(i, 10)
+		}
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return strconv.FormatInt(int64(f), 10)
+		}
+	case "double", "float64":
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	case "float32":
+		if f, err := strconv.ParseFloat(val, 32); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 32)
+		}
+	case "bool":
+		switch strings.ToLower(val) {
+		case "yes", "y", "on":
+			return "true"
+		case "no", "n", "off":
+			return "false"
+		}
+		if b, err := strconv.ParseBool(val); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case "string":
+		return val
+	}
+
+	return "\\N"
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var transformTestConfig = `
+files:
+  - name: api
+    file: /var/log/api.log
+    parse_mode: logfmt
+    time_format: 2006-01-02T15:04:05Z
+    field_mappings:
+      ts: ts
+      lvl: lvl
+      req: req
+      bytes: bytes
+      client: client
+      msg: msg
+    transforms:
+      - {type: rename, field: ts, to: event_datetime}
+      - {type: rename, field: lvl, to: log_level}
+      - {type: lowercase, field: log_level}
+      - {type: split, field: req, separator: " ", fields: [http_method, http_path]}
+      - {type: cast, field: bytes, to: integer}
+      - {type: copy, field: bytes, to: response_bytes}
+      - {type: replace, field: client, pattern: '^(\d+\.\d+)\.\d+\.\d+$', replacement: '$1.0.0'}
+      - {type: default, field: country, value: unknown}
+      - {type: set, field: app, value: api}
+      - {type: drop, fields: [req, msg]}
+`
+
+func TestTransforms(t *testing.T) {
+
+	config := parseYamlConfig(strings.NewReader(transformTestConfig))
+	logfile := config.Logfiles[0]
+	if err := logfile.applyTransforms(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(logfile.Transforms) != 10 {
+		t.Fatalf("expected 10 transforms, got %+v", logfile.Transforms)
+	}
+
+	format := []Attribute{
+		{"app", "string", 16, "", ""},
+		{"event_datetime", "timestamp", 0, "", ""},
+		{"log_level", "string", 16, "", ""},
+		{"http_method", "string", 8, "", ""},
+		{"http_path", "string", 256, "", ""},
+		{"response_bytes", "integer", 0, "", ""},
+		{"client", "string", 64, "", ""},
+		{"country", "string", 64, "", ""},
+	}
+	parser := NewLogfmtParser("pushr", "1.0", "api.log", "host-1", logfile.FieldMappings, format)
+
+	line := `ts=2017-01-02T03:04:05Z lvl=WARN req="GET /v1/users?id=1" bytes=512.0 client=10.1.2.3 msg=slow`
+	record, eventDatetime := processLine(logfile, parser, line, format)
+	if record == nil || eventDatetime == nil {
+		t.Fatalf("expected %q to be parsed", line)
+	}
+
+	expected := map[string]string{
+		"app":            "api",
+		"event_datetime": "2017-01-02T03:04:05Z",
+		"log_level":      "warn",
+		"http_method":    "GET",
+		"http_path":      "/v1/users?id=1",
+		"bytes":          "512",
+		"response_bytes": "512",
+		"client":         "10.1.0.0",
+		"country":        "unknown",
+	}
+	for k, v := range expected {
+		if record.EventAttributes[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, record.EventAttributes[k])
+		}
+	}
+	for _, k := range []string{"ts", "lvl", "req", "msg"} {
+		if _, ok := record.EventAttributes[k]; ok {
+			t.Errorf("expected %s to be gone, got %q", k, record.EventAttributes[k])
+		}
+	}
+}
+
+func TestTransformsAfterEnrichment(t *testing.T) {
+
+	logfile := Logfile{Name: "api", Transforms: []TransformConfig{
+		{Type: "cast", Field: "response_ms", To: "integer"},
+		{Type: "copy", Field: "browser", To: "device_tag"},
+	}}
+	if err := logfile.applyTransforms(); err != nil {
+		t.Fatal(err.Error())
+	}
+	parser := NewLogfmtParser("pushr", "1.0", "api.log", "host-1", map[string]string{"response_s": "took", "user_agent": "ua"}, testFormat)
+
+	line := `took=0.25 ua="Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/55.0.2883.87 Safari/537.36"`
+	record, _ := processLine(logfile, parser, line, testFormat)
+	if record == nil {
+		t.Fatalf("expected %q to be parsed", line)
+	}
+	if record.EventAttributes["response_ms"] != "250" || record.EventAttributes["device_tag"] != record.EventAttributes["browser"] ||
+		isUnset(record.EventAttributes["device_tag"]) {
+		t.Errorf("expected the transforms to see response_ms and browser, got %v", record.EventAttributes)
+	}
+}
+
+func TestTransformCast(t *testing.T) {
+
+	for _, test := range []struct {
+		val, to, expected string
+	}{
+		{"12", "integer", "12"},
+		{"12.9", "integer", "12"},
+		{"abc", "integer", "\\N"},
+		{"1e3", "double", "1000"},
+		{" 0.5 ", "float32", "0.5"},
+		{"Yes", "bool", "true"},
+		{"0", "bool", "false"},
+		{"maybe", "bool", "\\N"},
+		{"text", "string", "text"},
+	} {
+		if actual := castAttribute(test.val, test.to); actual != test.expected {
+			t.Errorf("expected %q as %s to be %q, got %q", test.val, test.to, test.expected, actual)
+		}
+	}
+
+	// split fills the fields there are no parts for with nulls
+	attributes := map[string]string{"version": "1.2"}
+	split := TransformConfig{Type: "split", Field: "version", Separator: ".", Fields: []string{"major", "minor", "patch"}}
+	split.apply(attributes)
+	if !reflect.DeepEqual(attributes, map[string]string{"version": "1.2", "major": "1", "minor": "2", "patch": "\\N"}) {
+		t.Errorf("unexpected split %v", attributes)
+	}
+
+	for _, transform := range []TransformConfig{
+		{Type: "explode", Field: "a"},
+		{Type: "rename", Field: "a"},
+		{Type: "lowercase"},
+		{Type: "replace", Field: "a", Pattern: "("},
+		{Type: "split", Field: "a", Fields: []string{"b"}},
+		{Type: "cast", Field: "a", To: "date"},
+	} {
+		logfile := Logfile{Name: "test", Transforms: []TransformConfig{transform}}
+		if err := logfile.applyTransforms(); err == nil {
+			t.Errorf("expected an error for %+v", transform)
+		}
+	}
+}
@@ -53,6 +53,8 @@ func TailServer(config ConfigFile) {
 	api := mux.NewRouter()
 	api.Handle("/1/tail", tailHandler)
 	api.Handle("/1/list_files", &ListFilesHandler{config})
+	api.HandleFunc("/1/parser_stats", parserStats)
+	api.HandleFunc("/1/filter_stats", filterStats)
 	api.HandleFunc("/1/subscribe", subscribeRaw)
 	api.HandleFunc("/1/subscribe_parsed", subscribeParsed)
 
@@ -342,7 +344,11 @@ func subscribeRaw(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		p := []byte(line)
+		if line.Rotation != nil {
+			continue
+		}
+
+		p := []byte(line.Text)
 		if err := conn.WriteMessage(websocket.TextMessage, p); err != nil {
 			break
 		}
@@ -436,6 +442,46 @@ func (l *ListFilesHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	fmt.Fprint(rw, w.String())
 }
 
+// parserStats returns the hit counters of the parser chains
+func parserStats(rw http.ResponseWriter, req *http.Request) {
+
+	resp := struct {
+		ParserHits map[string]map[string]uint64 `json:"parser_hits"`
+	}{
+		ParserHits: ParserHits(),
+	}
+
+	w := new(bytes.Buffer)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		http.Error(rw, "json encoding failed", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, w.String())
+}
+
+// filterStats returns the counters of the lines the filters dropped
+func filterStats(rw http.ResponseWriter, req *http.Request) {
+
+	resp := struct {
+		Dropped map[string]map[string]uint64 `json:"dropped"`
+	}{
+		Dropped: FilterDrops(),
+	}
+
+	w := new(bytes.Buffer)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		http.Error(rw, "json encoding failed", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, w.String())
+}
+
 type Group struct {
 	Name      string `json:"name"`
 	Instances []*autoscaling.Instance